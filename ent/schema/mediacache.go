@@ -0,0 +1,43 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// MediaCache holds the schema definition for the MediaCache entity.
+// It maps a canonical link to the file Telegram stored on the first upload,
+// so the link is answered again by the file_id without downloading it.
+type MediaCache struct {
+	ent.Schema
+}
+
+// Fields of the MediaCache.
+func (MediaCache) Fields() []ent.Field {
+	return []ent.Field{
+		field.String("link").NotEmpty(),
+		field.String("mode").Default("video"),
+		field.String("fileID").NotEmpty(),
+		field.String("fileUniqueID").Optional(),
+		field.Int64("fileSize").Optional(),
+		field.Float("duration").Optional(),
+		field.String("title").Optional(),
+		field.String("uploader").Optional(),
+		field.Time("createdAt").Default(time.Now),
+	}
+}
+
+// Edges of the MediaCache.
+func (MediaCache) Edges() []ent.Edge {
+	return nil
+}
+
+// Indexes of the MediaCache.
+func (MediaCache) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("link", "mode").Unique(),
+	}
+}
@@ -1,8 +1,11 @@
 package schema
 
 import (
+	"time"
+
 	"entgo.io/ent"
 	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
 )
 
 // Task holds the schema definition for the Task entity.
@@ -13,14 +16,38 @@ type Task struct {
 // Fields of the Task.
 func (Task) Fields() []ent.Field {
 	return []ent.Field{
-		field.String("link").NotEmpty().Unique(),
+		field.String("link").NotEmpty(),
+		field.String("mode").Default("video"),
 		field.JSON("groupIDs", []int64{}),
+		field.Int64("groupID").Default(0),
+		field.Int("priority").Default(0),
+		field.Int("queueRank").Default(0),
 		field.JSON("statusMessageIDs", map[int64]int{}).Optional(),
+		field.JSON("requesters", map[int64]string{}).Optional(),
 		field.String("status").Default("pending"),
+		field.Int("attempts").Default(0),
+		field.String("lastError").Optional(),
+		field.Time("nextAttemptAt").Optional().Nillable(),
+		field.String("workerID").Optional(),
+		field.Time("leaseExpiresAt").Optional().Nillable(),
+		field.Time("createdAt").Optional().Nillable().Immutable().Default(time.Now),
+		field.Time("startedAt").Optional().Nillable(),
+		// Increased by every change of the groups, so concurrent changes don't overwrite each other
+		field.Int("version").Default(0),
 	}
 }
 
 // Edges of the Task.
 func (Task) Edges() []ent.Edge {
 	return nil
+}
+
+// Indexes of the Task.
+func (Task) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("status", "priority", "queueRank"),
+		index.Fields("groupID", "status"),
+		// A link may be queued once per mode, e.g. as a video and as audio
+		index.Fields("link", "mode").Unique(),
+	}
 }
\ No newline at end of file
@@ -0,0 +1,45 @@
+package schema
+
+import (
+	"time"
+
+	"entgo.io/ent"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// TaskHistory holds the schema definition for the TaskHistory entity.
+// Finished tasks are moved here from Task, so the link can be requested again.
+type TaskHistory struct {
+	ent.Schema
+}
+
+// Fields of the TaskHistory.
+func (TaskHistory) Fields() []ent.Field {
+	return []ent.Field{
+		field.String("link").NotEmpty(),
+		field.String("mode").Default("video"),
+		field.JSON("groupIDs", []int64{}),
+		field.String("status"),
+		field.String("platform").Optional(),
+		field.Int64("fileSize").Optional(),
+		field.Float("duration").Optional(),
+		field.String("error").Optional(),
+		field.Int("attempts").Default(0),
+		field.Time("createdAt").Optional().Nillable(),
+		field.Time("startedAt").Optional().Nillable(),
+		field.Time("finishedAt").Default(time.Now),
+	}
+}
+
+// Edges of the TaskHistory.
+func (TaskHistory) Edges() []ent.Edge {
+	return nil
+}
+
+// Indexes of the TaskHistory.
+func (TaskHistory) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("finishedAt"),
+	}
+}
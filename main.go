@@ -25,9 +25,15 @@ func main() {
 		fx.Provide(
 			src.NewBotAPI,
 		),
+		fx.Provide(
+			src.NewRateLimiter,
+		),
 		fx.Provide(
 			src.NewDatabase,
 		),
+		fx.Provide(
+			src.NewWebhookServer,
+		),
 		fx.Provide(
 			src.NewBotRepository,
 		),
@@ -43,9 +49,15 @@ func main() {
 		fx.Provide(
 			src.NewVideoDownloadRepository,
 		),
+		fx.Provide(
+			src.NewVideoCompressRepository,
+		),
 		fx.Provide(
 			src.NewUploadRepository,
 		),
+		fx.Provide(
+			src.NewMediaCacheRepository,
+		),
 		fx.Provide(
 			src.NewBotService,
 		),
@@ -1,26 +1,203 @@
 package core
 
+import "time"
+
 const (
 	DownloaderConfigPath = "config/Config.pkl"
 	DatabaseDriver       = "sqlite3"
-	DatabaseSource       = "file:database.db?_fk=1&_journal_mode=WAL"
+	DatabaseSource       = "file:database.db?_fk=1&_journal_mode=WAL&_busy_timeout=5000"
 	ActivateCommandKey   = "activateGroup"
 	DeactivateCommandKey = "deactivateGroup"
 	GetBotCommandsKey    = "getBotCommands"
 	GetServerLoadKey     = "getServerLoad"
 	LoadResourceKey      = "loadResource"
+	LoadAudioResourceKey = "loadAudioResource"
+	CancelResourceKey    = "cancelResource"
 	GetAllGroupsKey      = "getAllGroups"
 	DeleteGroupKey       = "deleteGroup"
 	StartBotKey          = "start"
 
+	// Upload limits of the Telegram Bot API in MB
+	CloudBotAPIMaxUploadMB = 50
+	LocalBotAPIMaxUploadMB = 2000
+
 	// Video processing constants
 	VideoTempDirectory   = "temp/videos"
 	VideoOutputDirectory = "output/videos"
 	URLRegexPattern      = `^https?://[^\s/$.?#].[^\s]*$`
+
+	// DownloadedFilePrintTemplate makes yt-dlp print the final path, duration and tags
+	// of the downloaded file as JSON once all post-processing is done
+	DownloadedFilePrintTemplate = "after_move:%(.{filepath,duration,title,track,artist,uploader})j"
+
+	// AudioModeFlag makes loadResource download only the audio: /l -a {link}
+	AudioModeFlag = "-a"
+
+	// AudioThumbnailFormat is the format thumbnails of audios are converted to, the only one Telegram accepts
+	AudioThumbnailFormat = "jpg"
+
+	// AudioThumbnailPostProcessorArgs scales thumbnails down to the 320px Telegram allows for audio thumbnails
+	AudioThumbnailPostProcessorArgs = "ThumbnailsConvertor+ffmpeg_o:-vf scale=320:320:force_original_aspect_ratio=decrease"
+
+	// DownloadOutputTemplate names downloaded files, the id keeps the files of a multi-item post apart
+	DownloadOutputTemplate = "%(title).100B [%(id)s].%(ext)s"
+
+	// MaxMediaItemsPerLink caps the files downloaded for a carousel or a post with several videos
+	MaxMediaItemsPerLink = 30
+
+	// MediaGroupMaxItems is the number of files Telegram accepts in a single media group
+	MediaGroupMaxItems = 10
+
+	// UploadMaxAttempts is the number of times a request sending media is made when Telegram
+	// asks to wait (flood control) or its servers fail
+	UploadMaxAttempts = 5
+
+	// UploadRetryDelay is the delay before repeating a request failed by the Telegram servers,
+	// it grows with every attempt. Flood waits use the delay Telegram asks for.
+	UploadRetryDelay = 5 * time.Second
+
+	// WebhookSecretTokenHeader carries the secret token of the webhook in the requests of Telegram
+	WebhookSecretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+	// WebhookMaxBodyBytes is the largest update accepted by the webhook
+	WebhookMaxBodyBytes = 1 << 20
+
+	// WebhookReadHeaderTimeout bounds reading the headers of a webhook request
+	WebhookReadHeaderTimeout = 10 * time.Second
+
+	// WebhookUpdateBuffer is the number of updates received by the webhook waiting to be handled
+	WebhookUpdateBuffer = 100
+
+	// WebhookDeleteRetryInterval is the wait before deleting a webhook left by a previous run is tried again,
+	// long polling does not receive updates while it is set
+	WebhookDeleteRetryInterval = 5 * time.Second
+
+	// CallbackDataSigningLabel derives the key signing the data of inline keyboard buttons from the bot token,
+	// buttons of messages sent with another token are rejected
+	CallbackDataSigningLabel = "tg-downloader callback data"
+
+	// CallbackDataSignatureLength is the number of HMAC bytes kept in the data of a button,
+	// Telegram allows only 64 bytes of callback data
+	CallbackDataSignatureLength = 8
+
+	// GroupsPageSize is the number of groups listed on a page of the admin group list
+	GroupsPageSize = 5
+
+	// MessageSendTimeout bounds waiting for the rate limits before a message is sent or edited,
+	// a message which can't be sent in time is given up
+	MessageSendTimeout = time.Minute
+
+	// MessageEditTimeout bounds waiting for the rate limits before a queued edit of a status message,
+	// a newer edit queued meanwhile replaces it anyway
+	MessageEditTimeout = 2 * time.Minute
+
+	// RateLimiterCleanupInterval is how often the rate limiter forgets the groups nothing was sent to lately
+	RateLimiterCleanupInterval = 10 * time.Minute
+
+	// CaptionMaxLength is the number of characters (UTF-16 code units) Telegram allows in a media caption
+	CaptionMaxLength = 1024
+
+	// CaptionPartSeparator separates the caption of a link from the caption of the item, e.g. the part number
+	CaptionPartSeparator = "\n\n"
+
+	// ContentSniffLength is the number of leading bytes read to detect the MIME type of a downloaded file
+	ContentSniffLength = 512
+
+	// Limits of Telegram photos, larger images are sent as documents
+	PhotoMaxSizeMB        = 10
+	PhotoMaxDimensionsSum = 10000 // width + height in pixels
+	PhotoMaxAspectRatio   = 20
+
+	// MetadataProbeTimeout bounds the yt-dlp call reading media metadata before a download
+	MetadataProbeTimeout = 2 * time.Minute
+
+	// CompressionTargetPercent is the share of the size limit re-encoding aims at,
+	// the rest is left for the container overhead and bitrate fluctuations
+	CompressionTargetPercent = 95
+
+	// VideoInspectTimeout bounds reading the attributes and extracting the thumbnail of a single video
+	VideoInspectTimeout = time.Minute
+
+	// VideoThumbnailSuffix replaces the extension of a video to name its thumbnail
+	VideoThumbnailSuffix = ".thumb.jpg"
+
+	// VideoThumbnailSize is the largest side of a video thumbnail in pixels, Telegram allows up to 320
+	VideoThumbnailSize = 320
+
+	// DownloadProgressInterval is how often yt-dlp reports download progress,
+	// status messages are updated less often, see WorkerConfiguration.progressUpdateIntervalSeconds
+	DownloadProgressInterval = time.Second
+
+	// ProgressEditBudgetPercent is the share in percent of the group messages left after the upload reserve
+	// that download progress updates may take, the rest is kept for commands and the other status messages
+	ProgressEditBudgetPercent = 50
+
+	// EventEmitTimeout bounds waiting for the bot to take an event changing the stage of a task
+	// while the event channel is full
+	EventEmitTimeout = 30 * time.Second
+
+	// StaleTaskError is recorded for an attempt whose worker stopped renewing the lease of the task
+	StaleTaskError = "the worker processing the task stopped responding"
+
+	// Task history constants
+	TaskHistoryPruneInterval = time.Hour
+
+	// QueueETASampleSize is the number of recently completed tasks used to estimate queue waiting times
+	QueueETASampleSize = 20
 )
 
 var (
 	BotAllowedUpdates = []string{
 		"message",
+		"callback_query",
 	}
-)
+
+	// PermanentDownloadErrorMarkers are lowercase yt-dlp error fragments
+	// which mean that retrying the download will not help
+	PermanentDownloadErrorMarkers = []string{
+		"unsupported url",
+		"is not a valid url",
+		"video unavailable",
+		"private video",
+		"this video is private",
+		"has been removed",
+		"no video formats found",
+		"requested format is not available",
+		"http error 404",
+		"http error 410",
+		"max-filesize",
+	}
+
+	// TelegramErrorDescriptionCodes maps the status text Telegram starts error descriptions with
+	// to the HTTP status, for errors tgbotapi returns without their code
+	TelegramErrorDescriptionCodes = map[string]int{
+		"Bad Request":              400,
+		"Unauthorized":             401,
+		"Forbidden":                403,
+		"Not Found":                404,
+		"Conflict":                 409,
+		"Request Entity Too Large": 413,
+		"Too Many Requests":        429,
+		"Internal Server Error":    500,
+		"Bad Gateway":              502,
+		"Service Unavailable":      503,
+		"Gateway Timeout":          504,
+	}
+
+	// LinkTrackingParameters are query parameters dropped from links before they are used as
+	// media cache keys, they don't change the media. Parameters starting with "utm_" are dropped too.
+	LinkTrackingParameters = []string{
+		"si",
+		"feature",
+		"pp",
+		"igsh",
+		"igshid",
+		"fbclid",
+		"gclid",
+		"ref",
+		"ref_src",
+		"share_id",
+		"is_from_webapp",
+		"sender_device",
+	}
+)
\ No newline at end of file
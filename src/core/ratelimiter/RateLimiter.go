@@ -0,0 +1,159 @@
+package ratelimiter
+
+import (
+	"context"
+	"math"
+	"sync"
+	"tg-downloader/env"
+	"tg-downloader/src/core"
+	"time"
+)
+
+// Priority decides how much of the limits a request may use
+type Priority int
+
+const (
+	// PriorityNormal is used for status messages and replies, they can't use the share kept for uploads
+	PriorityNormal Priority = iota
+	// PriorityUpload is used for media sent to groups, it may use the whole limits
+	PriorityUpload
+)
+
+// RateLimiter keeps outgoing Bot API requests within the limits of Telegram: about 30 messages per second
+// to all chats and 20 messages per minute to a single group. Requests over the limits wait for their turn.
+// A share of both limits is kept for uploads, so status updates of many tasks don't hold back the media.
+type RateLimiter struct {
+	global      *tokenBucket
+	groups      map[int64]*tokenBucket
+	groupRate   float64 // tokens per second
+	groupBurst  float64
+	reserve     float64 // share of a bucket only uploads may use
+	lastCleanup time.Time
+	mutex       sync.Mutex
+}
+
+// NewRateLimiter creates a limiter with full buckets from the configured limits.
+func NewRateLimiter(config env.RateLimitConfiguration) *RateLimiter {
+	now := time.Now()
+	globalRate := float64(config.GlobalRequestsPerSecond)
+	groupBurst := float64(config.GroupRequestsPerMinute)
+
+	return &RateLimiter{
+		global:      newTokenBucket(globalRate, globalRate, now),
+		groups:      make(map[int64]*tokenBucket),
+		groupRate:   groupBurst / 60,
+		groupBurst:  groupBurst,
+		reserve:     float64(config.UploadReservePercent) / 100,
+		lastCleanup: now,
+	}
+}
+
+// Wait blocks until the given number of messages may be sent to the chat, or the context is done.
+// Groups have negative IDs and are limited on their own as well, other chats only by the global limit.
+func (l *RateLimiter) Wait(ctx context.Context, chatID int64, messages int, priority Priority) error {
+	for {
+		delay := l.take(chatID, float64(messages), priority)
+		if delay <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// take takes the tokens from the buckets of the request when all of them have enough,
+// otherwise it returns how long to wait before trying again
+func (l *RateLimiter) take(chatID int64, messages float64, priority Priority) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.cleanup(now)
+
+	buckets := []*tokenBucket{l.global}
+	if chatID < 0 {
+		group, ok := l.groups[chatID]
+		if !ok {
+			group = newTokenBucket(l.groupRate, l.groupBurst, now)
+			l.groups[chatID] = group
+		}
+		buckets = append(buckets, group)
+	}
+
+	var delay time.Duration
+	for _, bucket := range buckets {
+		bucket.refill(now)
+		delay = max(delay, bucket.delay(l.required(bucket, messages, priority)))
+	}
+	if delay > 0 {
+		return delay
+	}
+
+	for _, bucket := range buckets {
+		bucket.tokens -= min(messages, bucket.burst)
+	}
+	return 0
+}
+
+// required is the number of tokens the bucket must hold for the request, normal requests have to leave
+// the reserved share untouched
+func (l *RateLimiter) required(bucket *tokenBucket, messages float64, priority Priority) float64 {
+	// A request larger than the bucket waits for a full bucket instead of forever
+	messages = min(messages, bucket.burst)
+	if priority == PriorityUpload {
+		return messages
+	}
+	return min(messages+math.Ceil(bucket.burst*l.reserve), bucket.burst)
+}
+
+// cleanup forgets the buckets of groups that are full again, they are created anew on the next request
+func (l *RateLimiter) cleanup(now time.Time) {
+	if now.Sub(l.lastCleanup) < core.RateLimiterCleanupInterval {
+		return
+	}
+	l.lastCleanup = now
+
+	for chatID, bucket := range l.groups {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.burst {
+			delete(l.groups, chatID)
+		}
+	}
+}
+
+// tokenBucket holds up to burst tokens and gains rate tokens per second, a message takes one
+type tokenBucket struct {
+	rate    float64
+	burst   float64
+	tokens  float64
+	updated time.Time
+}
+
+func newTokenBucket(rate float64, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:    rate,
+		burst:   burst,
+		tokens:  burst,
+		updated: now,
+	}
+}
+
+// refill adds the tokens gained since the last update
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.updated).Seconds()*b.rate)
+	b.updated = now
+}
+
+// delay returns how long it takes until the bucket holds the tokens, 0 if it already does
+func (b *tokenBucket) delay(tokens float64) time.Duration {
+	if b.tokens >= tokens {
+		return 0
+	}
+	return time.Duration((tokens - b.tokens) / b.rate * float64(time.Second))
+}
\ No newline at end of file
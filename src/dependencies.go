@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"log"
 	"tg-downloader/ent"
+	"tg-downloader/ent/migrate"
 	"tg-downloader/env"
 	"tg-downloader/src/core"
 	"tg-downloader/src/core/logger"
+	"tg-downloader/src/core/ratelimiter"
 	"tg-downloader/src/features/bot/data/repository"
 	i "tg-downloader/src/features/bot/domain/repository"
 	"tg-downloader/src/features/bot/domain/service"
@@ -32,6 +34,22 @@ func NewBotConfiguration() env.TGDownloader {
 		log.Fatal("Failed to load configuration of bot. Error: ", err)
 	}
 
+	// Only a local Bot API server accepts files over the cloud limit
+	maxUploadMB := core.CloudBotAPIMaxUploadMB
+	if cfg.TelegramConfiguration.LocalBotAPI {
+		maxUploadMB = core.LocalBotAPIMaxUploadMB
+	}
+	if cfg.VideoDownloaderConfiguration.MaxFileSizeMB > maxUploadMB {
+		log.Fatalf("maxFileSizeMB is %d, but the Bot API accepts uploads up to %d MB", cfg.VideoDownloaderConfiguration.MaxFileSizeMB, maxUploadMB)
+	}
+	if cfg.AudioDownloaderConfiguration.MaxFileSizeMB > maxUploadMB {
+		log.Fatalf("audio maxFileSizeMB is %d, but the Bot API accepts uploads up to %d MB", cfg.AudioDownloaderConfiguration.MaxFileSizeMB, maxUploadMB)
+	}
+
+	if webhook := cfg.TelegramConfiguration.Webhook; webhook != nil && (webhook.TlsCertificateFile == nil) != (webhook.TlsKeyFile == nil) {
+		log.Fatal("webhook tlsCertificateFile and tlsKeyFile have to be set together")
+	}
+
 	return cfg
 }
 
@@ -52,7 +70,9 @@ func NewDatabase(cfg env.TGDownloader, logger *logger.Logger, lc fx.Lifecycle) *
 		OnStart: func(ctx context.Context) error {
 			logger.Info("Running migrations...")
 
-			return client.Schema.Create(context.Background())
+			// Indexes removed from the schema are dropped, e.g. the unique index of the task link
+			// replaced by the unique index of the link and the mode
+			return client.Schema.Create(context.Background(), migrate.WithDropIndex(true))
 		},
 		OnStop: func(ctx context.Context) error {
 			logger.Info("Closing database connection...")
@@ -64,7 +84,12 @@ func NewDatabase(cfg env.TGDownloader, logger *logger.Logger, lc fx.Lifecycle) *
 }
 
 func NewBotAPI(cfg env.TGDownloader, lc fx.Lifecycle, logger *logger.Logger) *tgbotapi.BotAPI {
-	bot, err := tgbotapi.NewBotAPI(cfg.TelegramConfiguration.TgBotApiKey)
+	endpoint := tgbotapi.APIEndpoint
+	if cfg.TelegramConfiguration.ApiEndpoint != nil && *cfg.TelegramConfiguration.ApiEndpoint != "" {
+		endpoint = *cfg.TelegramConfiguration.ApiEndpoint
+	}
+
+	bot, err := tgbotapi.NewBotAPIWithAPIEndpoint(cfg.TelegramConfiguration.TgBotApiKey, endpoint)
 
 	if err != nil {
 		logger.Error(fmt.Sprintf("Failed to create bot instance. Error: %s", err))
@@ -83,8 +108,33 @@ func NewBotAPI(cfg env.TGDownloader, lc fx.Lifecycle, logger *logger.Logger) *tg
 	return bot
 }
 
-func NewBotRepository(cfg env.TGDownloader, botApi *tgbotapi.BotAPI) i.IBotRepository {
-	repo := repository.NewBotRepository(cfg, botApi)
+// NewRateLimiter creates the limiter shared by everything sending requests to the Bot API
+func NewRateLimiter(cfg env.TGDownloader) *ratelimiter.RateLimiter {
+	return ratelimiter.NewRateLimiter(cfg.RateLimitConfiguration)
+}
+
+// NewWebhookServer creates the server receiving updates when a webhook is configured, without one
+// updates are received by long polling and nil is returned. The webhook is set and deleted with the app.
+func NewWebhookServer(cfg env.TGDownloader, botApi *tgbotapi.BotAPI, lc fx.Lifecycle, logger *logger.Logger) *repository.WebhookServer {
+	if cfg.TelegramConfiguration.Webhook == nil {
+		return nil
+	}
+
+	server := repository.NewWebhookServer(*cfg.TelegramConfiguration.Webhook, botApi, logger)
+
+	lc.Append(fx.Hook{
+		OnStart: server.Start,
+		OnStop: func(ctx context.Context) error {
+			logger.Info("Deleting webhook...")
+			return server.Stop(ctx)
+		},
+	})
+
+	return server
+}
+
+func NewBotRepository(cfg env.TGDownloader, botApi *tgbotapi.BotAPI, limiter *ratelimiter.RateLimiter, webhook *repository.WebhookServer, logger *logger.Logger) i.IBotRepository {
+	repo := repository.NewBotRepository(cfg, botApi, limiter, webhook, logger)
 
 	return repo
 }
@@ -111,12 +161,20 @@ func NewVideoDownloadRepository(cfg env.TGDownloader) iVideoRepo.IVideoDownloadR
 	return videoRepo.NewVideoDownloadRepository(cfg)
 }
 
-func NewUploadRepository(botApi *tgbotapi.BotAPI) iVideoRepo.IUploadRepository {
-	return videoRepo.NewUploadRepository(botApi)
+func NewVideoCompressRepository(cfg env.TGDownloader) iVideoRepo.IVideoCompressRepository {
+	return videoRepo.NewVideoCompressRepository(cfg)
+}
+
+func NewUploadRepository(cfg env.TGDownloader, botApi *tgbotapi.BotAPI, limiter *ratelimiter.RateLimiter) iVideoRepo.IUploadRepository {
+	return videoRepo.NewUploadRepository(cfg, botApi, limiter)
 }
 
-func NewVideoService(cfg env.TGDownloader, taskRepo i.ITaskRepository, downloadRepo iVideoRepo.IVideoDownloadRepository, uploadRepo iVideoRepo.IUploadRepository, logger *logger.Logger) videoService.IVideoService {
-	return videoService.NewVideoService(cfg, taskRepo, downloadRepo, uploadRepo, logger)
+func NewMediaCacheRepository(database *ent.Client) iVideoRepo.IMediaCacheRepository {
+	return videoRepo.NewMediaCacheRepository(database)
+}
+
+func NewVideoService(cfg env.TGDownloader, taskRepo i.ITaskRepository, downloadRepo iVideoRepo.IVideoDownloadRepository, compressRepo iVideoRepo.IVideoCompressRepository, uploadRepo iVideoRepo.IUploadRepository, mediaCache iVideoRepo.IMediaCacheRepository, logger *logger.Logger) videoService.IVideoService {
+	return videoService.NewVideoService(cfg, taskRepo, downloadRepo, compressRepo, uploadRepo, mediaCache, logger)
 }
 
 func NewBotController(botService service.IBotService, videoService videoService.IVideoService, logger *logger.Logger) controller.IBotController {
@@ -138,4 +196,4 @@ func NewLogger(strategies []logger.ILoggerStrategy) *logger.Logger {
 // NewFxLogger creates a new FX event logger that uses our custom Logger
 func NewFxLogger(logger *logger.Logger) fxevent.Logger {
 	return logger.NewFxLogger(logger)
-}
+}
\ No newline at end of file
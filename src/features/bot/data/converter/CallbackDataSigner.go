@@ -0,0 +1,74 @@
+package converter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"tg-downloader/env"
+	"tg-downloader/src/core"
+	"tg-downloader/src/features/bot/domain/entity"
+)
+
+// ErrInvalidCallbackData is returned for button data that is malformed or not signed by the bot
+var ErrInvalidCallbackData = errors.New("invalid callback data")
+
+// CallbackDataSigner encodes the data of inline keyboard buttons compactly and signs it.
+// The signature covers the chat the button is sent to, so data can't be made up or moved to another chat.
+type CallbackDataSigner struct {
+	key []byte
+}
+
+func NewCallbackDataSigner(environment env.TGDownloader) *CallbackDataSigner {
+	mac := hmac.New(sha256.New, []byte(environment.TelegramConfiguration.TgBotApiKey))
+	mac.Write([]byte(core.CallbackDataSigningLabel))
+
+	return &CallbackDataSigner{
+		key: mac.Sum(nil),
+	}
+}
+
+// Sign encodes the data as the action byte and varint arguments followed by a truncated HMAC,
+// with two arguments it takes at most 39 of the 64 bytes Telegram allows
+func (s *CallbackDataSigner) Sign(chatID int64, data entity.CallbackData) string {
+	payload := []byte{byte(data.Action)}
+	for _, arg := range data.Args {
+		payload = binary.AppendVarint(payload, arg)
+	}
+
+	signed := append(payload, s.signature(chatID, payload)...)
+	return base64.RawURLEncoding.EncodeToString(signed)
+}
+
+// Verify decodes data signed by Sign for the same chat
+func (s *CallbackDataSigner) Verify(chatID int64, signed string) (entity.CallbackData, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(signed)
+	if err != nil || len(decoded) <= core.CallbackDataSignatureLength {
+		return entity.CallbackData{}, ErrInvalidCallbackData
+	}
+
+	payload := decoded[:len(decoded)-core.CallbackDataSignatureLength]
+	if !hmac.Equal(decoded[len(payload):], s.signature(chatID, payload)) {
+		return entity.CallbackData{}, ErrInvalidCallbackData
+	}
+
+	data := entity.CallbackData{Action: entity.CallbackAction(payload[0])}
+	for rest := payload[1:]; len(rest) > 0; {
+		arg, n := binary.Varint(rest)
+		if n <= 0 {
+			return entity.CallbackData{}, ErrInvalidCallbackData
+		}
+		data.Args = append(data.Args, arg)
+		rest = rest[n:]
+	}
+
+	return data, nil
+}
+
+func (s *CallbackDataSigner) signature(chatID int64, payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(chatID)))
+	mac.Write(payload)
+	return mac.Sum(nil)[:core.CallbackDataSignatureLength]
+}
\ No newline at end of file
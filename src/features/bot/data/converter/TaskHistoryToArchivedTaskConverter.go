@@ -0,0 +1,35 @@
+package converter
+
+import (
+	"tg-downloader/ent"
+	"tg-downloader/src/core"
+	"tg-downloader/src/features/bot/domain/entity"
+)
+
+type TaskHistoryToArchivedTaskConverter struct{}
+
+func NewTaskHistoryToArchivedTaskConverter() *TaskHistoryToArchivedTaskConverter {
+	return &TaskHistoryToArchivedTaskConverter{}
+}
+
+func (c *TaskHistoryToArchivedTaskConverter) Convert() core.Codec[ent.TaskHistory, entity.ArchivedTask] {
+	return &taskHistoryToArchivedTaskCodec{}
+}
+
+type taskHistoryToArchivedTaskCodec struct{}
+
+func (c *taskHistoryToArchivedTaskCodec) Convert(source ent.TaskHistory) entity.ArchivedTask {
+	return entity.ArchivedTask{
+		ID:       source.ID,
+		Link:     source.Link,
+		Mode:     entity.TaskMode(source.Mode),
+		GroupIDs: source.GroupIDs,
+		Outcome: entity.TaskOutcome{
+			Status:   entity.TaskStatus(source.Status),
+			Platform: source.Platform,
+			FileSize: source.FileSize,
+			Duration: source.Duration,
+			Error:    source.Error,
+		},
+	}
+}
\ No newline at end of file
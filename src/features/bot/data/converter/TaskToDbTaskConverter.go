@@ -26,9 +26,21 @@ func (c *taskToDbTaskCodec) Convert(source ent.Task) entity.Task {
 	return entity.Task{
 		ID:               source.ID,
 		Link:             source.Link,
+		Mode:             entity.TaskMode(source.Mode),
 		GroupIDs:         source.GroupIDs,
+		GroupID:          source.GroupID,
+		Priority:         entity.TaskPriority(source.Priority),
+		QueueRank:        source.QueueRank,
 		StatusMessageIDs: source.StatusMessageIDs,
+		Requesters:       source.Requesters,
 		Status:           entity.TaskStatus(source.Status),
+		Attempts:         source.Attempts,
+		LastError:        source.LastError,
+		NextAttemptAt:    source.NextAttemptAt,
+		WorkerID:         source.WorkerID,
+		LeaseExpiresAt:   source.LeaseExpiresAt,
+		CreatedAt:        source.CreatedAt,
+		StartedAt:        source.StartedAt,
 	}
 }
 
@@ -38,8 +50,20 @@ func (c *dbTaskToTaskCodec) Convert(source entity.Task) ent.Task {
 	return ent.Task{
 		ID:               source.ID,
 		Link:             source.Link,
+		Mode:             string(source.Mode),
 		GroupIDs:         source.GroupIDs,
+		GroupID:          source.GroupID,
+		Priority:         int(source.Priority),
+		QueueRank:        source.QueueRank,
 		StatusMessageIDs: source.StatusMessageIDs,
+		Requesters:       source.Requesters,
 		Status:           string(source.Status),
+		Attempts:         source.Attempts,
+		LastError:        source.LastError,
+		NextAttemptAt:    source.NextAttemptAt,
+		WorkerID:         source.WorkerID,
+		LeaseExpiresAt:   source.LeaseExpiresAt,
+		CreatedAt:        source.CreatedAt,
+		StartedAt:        source.StartedAt,
 	}
 }
\ No newline at end of file
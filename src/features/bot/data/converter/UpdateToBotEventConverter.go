@@ -13,17 +13,20 @@ import (
 
 type UpdateToBotEventConverter struct {
 	environment env.TGDownloader
+	signer      *CallbackDataSigner
 }
 
-func NewUpdateToBotEventConverter(environment env.TGDownloader) *UpdateToBotEventConverter {
+func NewUpdateToBotEventConverter(environment env.TGDownloader, signer *CallbackDataSigner) *UpdateToBotEventConverter {
 	return &UpdateToBotEventConverter{
 		environment: environment,
+		signer:      signer,
 	}
 }
 
 func (c *UpdateToBotEventConverter) Convert() core.Codec[tgbotapi.Update, entity.BotEvent] {
 	return &UpdateToBotEventCodec{
 		environment: c.environment,
+		signer:      c.signer,
 	}
 }
 
@@ -33,9 +36,14 @@ func (c *UpdateToBotEventConverter) Parse() core.Codec[entity.BotEvent, tgbotapi
 
 type UpdateToBotEventCodec struct {
 	environment env.TGDownloader
+	signer      *CallbackDataSigner
 }
 
 func (c *UpdateToBotEventCodec) Convert(source tgbotapi.Update) entity.BotEvent {
+	if source.CallbackQuery != nil {
+		return c.parseCallbackQuery(source.CallbackQuery)
+	}
+
 	if source.Message == nil {
 		return nil
 	}
@@ -85,11 +93,20 @@ func (c *UpdateToBotEventCodec) parseGroupCommand(message *tgbotapi.Message, gro
 			UserID:   userID,
 			UserName: userName,
 		}
-	case commands[core.LoadResourceKey].Command:
+	case commands[core.LoadResourceKey].Command, commands[core.LoadAudioResourceKey].Command:
 		// Handle load resource command with multiple scenarios:
 		// 1. Reply to message containing link: /l (as reply)
 		// 2. Direct command with link: /l {link}
+		// The audio command or the audio flag (/l -a) downloads only the audio
 		link := ""
+		mode := entity.TaskModeVideo
+		if command == commands[core.LoadAudioResourceKey].Command {
+			mode = entity.TaskModeAudio
+		}
+		if len(parts) >= 2 && parts[1] == core.AudioModeFlag {
+			mode = entity.TaskModeAudio
+			parts = append(parts[:1], parts[2:]...)
+		}
 
 		// Check if this is a reply to another message
 		if message.ReplyToMessage != nil {
@@ -104,9 +121,33 @@ func (c *UpdateToBotEventCodec) parseGroupCommand(message *tgbotapi.Message, gro
 		}
 
 		return entity.GetResource{
-			GroupID: groupID,
-			Link:    link,
+			GroupID:  groupID,
+			UserID:   userID,
+			UserName: userName,
+			Link:     link,
+			Mode:     mode,
+		}
+	case commands[core.CancelResourceKey].Command:
+		// Handle cancel command with two scenarios:
+		// 1. Reply to the status message or to the message with the link: /c (as reply)
+		// 2. Direct command with link: /c {link}
+		event := entity.CancelResource{
+			GroupID:  groupID,
+			UserID:   userID,
+			UserName: userName,
+		}
+
+		if message.ReplyToMessage != nil {
+			event.MessageID = message.ReplyToMessage.MessageID
+			replyText := strings.TrimSpace(message.ReplyToMessage.Text)
+			if hasLink, foundLink := c.extractLinkFromText(replyText); hasLink {
+				event.Link = foundLink
+			}
+		} else if len(parts) >= 2 {
+			event.Link = parts[1]
 		}
+
+		return event
 	case commands[core.GetBotCommandsKey].Command:
 		return entity.GroupGetBotCommands{
 			GroupID:  groupID,
@@ -117,8 +158,11 @@ func (c *UpdateToBotEventCodec) parseGroupCommand(message *tgbotapi.Message, gro
 		// Check if message contains a supported link
 		if hasLink, link := c.containsSupportedLink(messageText); hasLink {
 			return entity.GetResource{
-				GroupID: groupID,
-				Link:    link,
+				GroupID:  groupID,
+				UserID:   userID,
+				UserName: userName,
+				Link:     link,
+				Mode:     entity.TaskModeVideo,
 			}
 		}
 
@@ -187,6 +231,43 @@ func (c *UpdateToBotEventCodec) parseDirectCommand(messageText string, userID in
 	}
 }
 
+// parseCallbackQuery turns a pressed button into an event, the data of the button is trusted only
+// when it is signed for the chat the button was pressed in
+func (c *UpdateToBotEventCodec) parseCallbackQuery(query *tgbotapi.CallbackQuery) entity.BotEvent {
+	press := entity.ButtonPress{
+		CallbackQueryID: query.ID,
+		UserID:          query.From.ID,
+		UserName:        query.From.UserName,
+	}
+
+	// Buttons of inline mode messages are not sent by the bot
+	if query.Message == nil {
+		return entity.InvalidButtonPressed{ButtonPress: press}
+	}
+	press.ChatID = query.Message.Chat.ID
+	press.MessageID = query.Message.MessageID
+
+	data, err := c.signer.Verify(press.ChatID, query.Data)
+	if err != nil {
+		return entity.InvalidButtonPressed{ButtonPress: press}
+	}
+
+	switch {
+	case data.Action == entity.CallbackActionCancelResource && len(data.Args) == 0:
+		return entity.CancelResourcePressed{ButtonPress: press}
+	case data.Action == entity.CallbackActionRetryResource && len(data.Args) == 1:
+		return entity.RetryResourcePressed{ButtonPress: press, HistoryID: int(data.Args[0])}
+	case data.Action == entity.CallbackActionGroupsPage && len(data.Args) == 1:
+		return entity.GroupsPagePressed{ButtonPress: press, Page: int(data.Args[0])}
+	case data.Action == entity.CallbackActionDeleteGroup && len(data.Args) == 2:
+		return entity.DeleteGroupPressed{ButtonPress: press, GroupID: data.Args[0], Page: int(data.Args[1])}
+	case data.Action == entity.CallbackActionConfirmDeleteGroup && len(data.Args) == 2:
+		return entity.DeleteGroupConfirmed{ButtonPress: press, GroupID: data.Args[0], Page: int(data.Args[1])}
+	default:
+		return entity.InvalidButtonPressed{ButtonPress: press}
+	}
+}
+
 type BotEventToUpdateCodec struct{}
 
 func (c *BotEventToUpdateCodec) Convert(source entity.BotEvent) tgbotapi.Update {
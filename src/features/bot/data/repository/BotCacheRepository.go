@@ -54,7 +54,11 @@ func (r *BotCacheRepository) WriteGroup(group *entity.Group) error {
 }
 
 func (r *BotCacheRepository) GetAllGroupsByUserName(username string) ([]*entity.Group, error) {
-	instances, err := r.database.DbGroup.Query().Where(dbgroup.AdminUserName(username)).All(context.Background())
+	// Ordered so the pages of the group list stay the same between requests
+	instances, err := r.database.DbGroup.Query().
+		Where(dbgroup.AdminUserName(username)).
+		Order(ent.Asc(dbgroup.FieldID)).
+		All(context.Background())
 
 	if err != nil {
 		return nil, err
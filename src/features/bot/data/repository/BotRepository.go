@@ -1,11 +1,16 @@
 package repository
 
 import (
+	"context"
+	"fmt"
 	"strings"
 	"tg-downloader/env"
 	"tg-downloader/src/core"
+	"tg-downloader/src/core/logger"
+	"tg-downloader/src/core/ratelimiter"
 	"tg-downloader/src/features/bot/data/converter"
 	"tg-downloader/src/features/bot/domain/entity"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
@@ -13,31 +18,53 @@ import (
 type BotRepository struct {
 	environment      env.TGDownloader
 	botApi           *tgbotapi.BotAPI
+	limiter          *ratelimiter.RateLimiter
+	webhook          *WebhookServer // nil when updates are received by long polling
+	signer           *converter.CallbackDataSigner
+	edits            *MessageEditQueue
 	converter        *converter.UpdateToBotEventConverter
 	commandConverter *converter.CommandToBotCommandConverter
 	chatConverter    *converter.ChatToChatInfoConverter
+	logger           *logger.Logger
 }
 
-func NewBotRepository(environment env.TGDownloader, botApi *tgbotapi.BotAPI) *BotRepository {
-	return &BotRepository{
+func NewBotRepository(environment env.TGDownloader, botApi *tgbotapi.BotAPI, limiter *ratelimiter.RateLimiter, webhook *WebhookServer, logger *logger.Logger) *BotRepository {
+	signer := converter.NewCallbackDataSigner(environment)
+
+	repo := &BotRepository{
 		environment:      environment,
 		botApi:           botApi,
-		converter:        converter.NewUpdateToBotEventConverter(environment),
+		limiter:          limiter,
+		webhook:          webhook,
+		signer:           signer,
+		converter:        converter.NewUpdateToBotEventConverter(environment, signer),
 		commandConverter: converter.NewCommandToBotCommandConverter(),
 		chatConverter:    converter.NewChatToChatInfoConverter(),
+		logger:           logger,
 	}
+	repo.edits = NewMessageEditQueue(repo.edit, logger)
+
+	return repo
 }
 
 func (r *BotRepository) ReceiveEvents() entity.BotEvents {
 	ch := make(chan entity.BotEvent, r.environment.TelegramConfiguration.UpdateLimit)
 
 	go func() {
-		u := tgbotapi.NewUpdate(r.environment.TelegramConfiguration.UpdateOffset)
-		u.Timeout = r.environment.TelegramConfiguration.UpdateTimeout
-		u.AllowedUpdates = core.BotAllowedUpdates
-		u.Limit = r.environment.TelegramConfiguration.UpdateLimit
+		// Updates from the webhook and from long polling go through the same conversion
+		var channel tgbotapi.UpdatesChannel
+		if r.webhook != nil {
+			channel = r.webhook.Updates()
+		} else {
+			r.deleteWebhook()
 
-		channel := r.botApi.GetUpdatesChan(u)
+			u := tgbotapi.NewUpdate(r.environment.TelegramConfiguration.UpdateOffset)
+			u.Timeout = r.environment.TelegramConfiguration.UpdateTimeout
+			u.AllowedUpdates = core.BotAllowedUpdates
+			u.Limit = r.environment.TelegramConfiguration.UpdateLimit
+
+			channel = r.botApi.GetUpdatesChan(u)
+		}
 
 		for update := range channel {
 			codec := r.converter.Convert()
@@ -52,6 +79,20 @@ func (r *BotRepository) ReceiveEvents() entity.BotEvents {
 	return ch
 }
 
+// deleteWebhook removes a webhook left by a previous run in webhook mode, Telegram refuses getUpdates
+// while one is set. Updates waiting for the webhook are kept and received by polling.
+func (r *BotRepository) deleteWebhook() {
+	for {
+		_, err := r.request(0, tgbotapi.DeleteWebhookConfig{DropPendingUpdates: false})
+		if err == nil {
+			return
+		}
+
+		r.logger.Warn(fmt.Sprintf("Failed to delete webhook before polling, retrying in %s: %v", core.WebhookDeleteRetryInterval, err))
+		time.Sleep(core.WebhookDeleteRetryInterval)
+	}
+}
+
 func (r *BotRepository) IsAdmin(userName string) (bool, error) {
 	formattedName := strings.ToLower(strings.TrimSpace(userName))
 	for _, v := range r.environment.AuthConfiguration.Admininstrators {
@@ -73,7 +114,7 @@ func (r *BotRepository) SetCommandsForDirectMessages(userID int64, commands []en
 		botCommands...,
 	)
 
-	_, err := r.botApi.Request(setCommands)
+	_, err := r.request(0, setCommands)
 	return err
 }
 
@@ -85,7 +126,7 @@ func (r *BotRepository) SetCommandsForChatMember(chatID int64, userID int64, com
 		botCommands...,
 	)
 
-	_, err := r.botApi.Request(setCommands)
+	_, err := r.request(0, setCommands)
 	return err
 }
 
@@ -102,19 +143,40 @@ func (r *BotRepository) convertCommands(commands []entity.Command) []tgbotapi.Bo
 
 func (r *BotRepository) SendDirectMessage(userID int64, message string) error {
 	msg := tgbotapi.NewMessage(userID, message)
-	_, err := r.botApi.Send(msg)
+	_, err := r.send(userID, msg)
 	return err
 }
 
 func (r *BotRepository) SendGroupMessage(chatID int64, message string) error {
 	msg := tgbotapi.NewMessage(chatID, message)
-	_, err := r.botApi.Send(msg)
+	_, err := r.send(chatID, msg)
 	return err
 }
 
 func (r *BotRepository) SendGroupMessageWithID(chatID int64, message string) (int, error) {
 	msg := tgbotapi.NewMessage(chatID, message)
-	sentMsg, err := r.botApi.Send(msg)
+	sentMsg, err := r.send(chatID, msg)
+	if err != nil {
+		return 0, err
+	}
+	return sentMsg.MessageID, nil
+}
+
+func (r *BotRepository) SendDirectMessageWithKeyboard(userID int64, message string, keyboard entity.InlineKeyboard) error {
+	msg := tgbotapi.NewMessage(userID, message)
+	if markup := r.keyboardMarkup(userID, keyboard); markup != nil {
+		msg.ReplyMarkup = *markup
+	}
+	_, err := r.send(userID, msg)
+	return err
+}
+
+func (r *BotRepository) SendGroupMessageWithKeyboard(chatID int64, message string, keyboard entity.InlineKeyboard) (int, error) {
+	msg := tgbotapi.NewMessage(chatID, message)
+	if markup := r.keyboardMarkup(chatID, keyboard); markup != nil {
+		msg.ReplyMarkup = *markup
+	}
+	sentMsg, err := r.send(chatID, msg)
 	if err != nil {
 		return 0, err
 	}
@@ -123,20 +185,46 @@ func (r *BotRepository) SendGroupMessageWithID(chatID int64, message string) (in
 
 func (r *BotRepository) UpdateDirectMessage(userID int64, messageID int, newText string) error {
 	edit := tgbotapi.NewEditMessageText(userID, messageID, newText)
-	_, err := r.botApi.Send(edit)
+	_, err := r.send(userID, edit)
 	return err
 }
 
+// UpdateGroupMessage queues the edit of the message, see MessageEditQueue
 func (r *BotRepository) UpdateGroupMessage(chatID int64, messageID int, newText string) error {
 	edit := tgbotapi.NewEditMessageText(chatID, messageID, newText)
-	_, err := r.botApi.Send(edit)
+	r.edits.Enqueue(chatID, messageID, edit)
+	return nil
+}
+
+// UpdateDirectMessageWithKeyboard replaces the text and the buttons of the message, an empty keyboard removes the buttons
+func (r *BotRepository) UpdateDirectMessageWithKeyboard(userID int64, messageID int, newText string, keyboard entity.InlineKeyboard) error {
+	edit := tgbotapi.NewEditMessageText(userID, messageID, newText)
+	edit.ReplyMarkup = r.keyboardMarkup(userID, keyboard)
+	_, err := r.send(userID, edit)
+	return err
+}
+
+// UpdateGroupMessageWithKeyboard queues replacing the text and the buttons of the message, an empty keyboard
+// removes the buttons, see MessageEditQueue
+func (r *BotRepository) UpdateGroupMessageWithKeyboard(chatID int64, messageID int, newText string, keyboard entity.InlineKeyboard) error {
+	edit := tgbotapi.NewEditMessageText(chatID, messageID, newText)
+	edit.ReplyMarkup = r.keyboardMarkup(chatID, keyboard)
+	r.edits.Enqueue(chatID, messageID, edit)
+	return nil
+}
+
+// AnswerCallbackQuery stops the loading animation of a pressed button, a non-empty text is shown to the user
+func (r *BotRepository) AnswerCallbackQuery(callbackQueryID string, text string) error {
+	callback := tgbotapi.NewCallback(callbackQueryID, text)
+	_, err := r.request(0, callback)
 	return err
 }
 
+// DeleteGroupMessage queues the deletion of the message after its pending edits, see MessageEditQueue
 func (r *BotRepository) DeleteGroupMessage(chatID int64, messageID int) error {
 	deleteConfig := tgbotapi.NewDeleteMessage(chatID, messageID)
-	_, err := r.botApi.Request(deleteConfig)
-	return err
+	r.edits.Enqueue(chatID, messageID, deleteConfig)
+	return nil
 }
 
 func (r *BotRepository) GetChatInfo(chatID int64) (*entity.ChatInfo, error) {
@@ -146,6 +234,12 @@ func (r *BotRepository) GetChatInfo(chatID int64) (*entity.ChatInfo, error) {
 		},
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), core.MessageSendTimeout)
+	defer cancel()
+	if err := r.limiter.Wait(ctx, 0, 1, ratelimiter.PriorityNormal); err != nil {
+		return nil, err
+	}
+
 	chat, err := r.botApi.GetChat(chatConfig)
 	if err != nil {
 		return nil, err
@@ -155,3 +249,54 @@ func (r *BotRepository) GetChatInfo(chatID int64) (*entity.ChatInfo, error) {
 	chatInfo := codec.Convert(chat)
 	return &chatInfo, nil
 }
+
+// keyboardMarkup converts the keyboard to buttons with data signed for the chat, nil for an empty keyboard
+func (r *BotRepository) keyboardMarkup(chatID int64, keyboard entity.InlineKeyboard) *tgbotapi.InlineKeyboardMarkup {
+	if len(keyboard) == 0 {
+		return nil
+	}
+
+	rows := make([][]tgbotapi.InlineKeyboardButton, 0, len(keyboard))
+	for _, buttons := range keyboard {
+		row := make([]tgbotapi.InlineKeyboardButton, 0, len(buttons))
+		for _, button := range buttons {
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData(button.Text, r.signer.Sign(chatID, button.Data)))
+		}
+		rows = append(rows, row)
+	}
+
+	markup := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return &markup
+}
+
+// send waits for its turn under the Telegram rate limits of the chat and sends the message,
+// a message that can't be sent within core.MessageSendTimeout is not sent at all
+func (r *BotRepository) send(chatID int64, chattable tgbotapi.Chattable) (tgbotapi.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), core.MessageSendTimeout)
+	defer cancel()
+	if err := r.limiter.Wait(ctx, chatID, 1, ratelimiter.PriorityNormal); err != nil {
+		return tgbotapi.Message{}, err
+	}
+	return r.botApi.Send(chattable)
+}
+
+// request waits for its turn under the Telegram rate limits of the chat and makes the request,
+// requests not addressed to a chat pass 0 and count against the global limit only
+func (r *BotRepository) request(chatID int64, chattable tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), core.MessageSendTimeout)
+	defer cancel()
+	if err := r.limiter.Wait(ctx, chatID, 1, ratelimiter.PriorityNormal); err != nil {
+		return nil, err
+	}
+	return r.botApi.Request(chattable)
+}
+
+// edit waits for its turn under the Telegram rate limits of the chat and edits or deletes a message
+// for the edit queue, which bounds the wait by the context
+func (r *BotRepository) edit(ctx context.Context, chatID int64, chattable tgbotapi.Chattable) error {
+	if err := r.limiter.Wait(ctx, chatID, 1, ratelimiter.PriorityNormal); err != nil {
+		return err
+	}
+	_, err := r.botApi.Request(chattable)
+	return err
+}
\ No newline at end of file
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"tg-downloader/src/core"
+	"tg-downloader/src/core/logger"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// messageKey identifies a message of a chat
+type messageKey struct {
+	chatID    int64
+	messageID int
+}
+
+// MessageEditQueue applies the edits and the deletion of a message one after another, in the order they
+// were queued. An edit waiting for its turn under the rate limits is replaced by a newer one, so a status
+// message shows its latest state and never an older one, however many updates arrive while it waits.
+type MessageEditQueue struct {
+	send    func(ctx context.Context, chatID int64, chattable tgbotapi.Chattable) error
+	pending map[messageKey]tgbotapi.Chattable
+	running map[messageKey]bool
+	mutex   sync.Mutex
+	logger  *logger.Logger
+}
+
+func NewMessageEditQueue(send func(ctx context.Context, chatID int64, chattable tgbotapi.Chattable) error, logger *logger.Logger) *MessageEditQueue {
+	return &MessageEditQueue{
+		send:    send,
+		pending: make(map[messageKey]tgbotapi.Chattable),
+		running: make(map[messageKey]bool),
+		logger:  logger,
+	}
+}
+
+// Enqueue queues the edit or the deletion of the message without waiting for it, failures are logged
+func (q *MessageEditQueue) Enqueue(chatID int64, messageID int, chattable tgbotapi.Chattable) {
+	key := messageKey{chatID: chatID, messageID: messageID}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, replaced := q.pending[key]; replaced {
+		q.logger.Debug(fmt.Sprintf("Replacing pending edit of message %d in chat %d", messageID, chatID))
+	}
+	q.pending[key] = chattable
+
+	// A single goroutine per message sends its edits, the one already running takes the new edit next
+	if !q.running[key] {
+		q.running[key] = true
+		go q.process(key)
+	}
+}
+
+func (q *MessageEditQueue) process(key messageKey) {
+	for {
+		q.mutex.Lock()
+		chattable, ok := q.pending[key]
+		if !ok {
+			delete(q.running, key)
+			q.mutex.Unlock()
+			return
+		}
+		delete(q.pending, key)
+		q.mutex.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), core.MessageEditTimeout)
+		if err := q.send(ctx, key.chatID, chattable); err != nil {
+			q.logger.Warn(fmt.Sprintf("Failed to edit message %d in chat %d: %v", key.messageID, key.chatID, err))
+		}
+		cancel()
+	}
+}
\ No newline at end of file
@@ -2,47 +2,104 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
 	"tg-downloader/ent"
+	"tg-downloader/ent/predicate"
 	"tg-downloader/ent/task"
+	"tg-downloader/ent/taskhistory"
+	"tg-downloader/src/core"
 	"tg-downloader/src/features/bot/data/converter"
 	"tg-downloader/src/features/bot/domain/entity"
 	"tg-downloader/src/features/bot/domain/repository"
+	"time"
+
+	"entgo.io/ent/dialect/sql"
+	"entgo.io/ent/dialect/sql/sqljson"
 )
 
+// errTaskChanged is returned when a task was changed by someone else between reading and updating it
+var errTaskChanged = errors.New("task changed concurrently")
+
+// queueOrder is the order in which pending tasks are taken by workers
+var queueOrder = []task.OrderOption{
+	ent.Desc(task.FieldPriority),
+	ent.Asc(task.FieldQueueRank),
+	ent.Asc(task.FieldID),
+}
+
 type TaskRepository struct {
-	database  *ent.Client
-	converter *converter.TaskToDbTaskConverter
+	database         *ent.Client
+	converter        *converter.TaskToDbTaskConverter
+	historyConverter *converter.TaskHistoryToArchivedTaskConverter
 }
 
 func NewTaskRepository(database *ent.Client) repository.ITaskRepository {
 	return &TaskRepository{
-		database:  database,
-		converter: converter.NewTaskToDbTaskConverter(),
+		database:         database,
+		converter:        converter.NewTaskToDbTaskConverter(),
+		historyConverter: converter.NewTaskHistoryToArchivedTaskConverter(),
 	}
 }
 
-func (r *TaskRepository) CreateTask(link string, groupID int64, messageID int) (*entity.Task, error) {
+// CreateTask queues the link for the group, or adds the group to the task already queued for the link in the same mode.
+// A task gets a queue rank equal to the number of tasks its group already has in the queue, so a group
+// posting many links at once does not hold back the links of other groups.
+func (r *TaskRepository) CreateTask(ctx context.Context, link string, mode entity.TaskMode, groupID int64, messageID int, requester string, priority entity.TaskPriority) (*entity.Task, error) {
 	// Check if task with this link already exists
-	existingTask, err := r.FindTaskByLink(link)
+	existingTask, err := r.FindTaskByLink(ctx, link, mode)
 	if err == nil {
 		// Task exists, add group to it
-		err = r.AddGroupToTask(existingTask.ID, groupID, messageID)
+		err = r.AddGroupToTask(ctx, existingTask.ID, groupID, messageID, requester)
 		if err != nil {
 			return nil, err
 		}
+
+		// The task is processed as soon as the most important of its groups needs it
+		if priority > existingTask.Priority {
+			err = r.database.Task.UpdateOneID(existingTask.ID).
+				SetPriority(int(priority)).
+				Exec(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		// Return updated task
-		return r.FindTaskByLink(link)
+		return r.FindTaskByLink(ctx, link, mode)
+	}
+
+	// The rank is the round of the task in a round robin over the groups. It is intentionally not recomputed
+	// when the tasks ahead finish: tasks of a group with a backlog stay behind the first tasks of groups
+	// posting later, while the relative order of the tasks of a group is kept.
+	queueRank, err := r.database.Task.Query().
+		Where(
+			task.GroupID(groupID),
+			task.StatusIn(string(entity.TaskStatusPending), string(entity.TaskStatusInProgress)),
+		).
+		Count(ctx)
+
+	if err != nil {
+		return nil, err
 	}
 
-	// Create new task with statusMessageIDs map
+	// Create new task with statusMessageIDs and requesters maps
 	statusMessageIDs := map[int64]int{groupID: messageID}
+	requesters := map[int64]string{groupID: requester}
 
 	dbTask, err := r.database.Task.Create().
 		SetLink(link).
+		SetMode(string(mode)).
 		SetGroupIDs([]int64{groupID}).
+		SetGroupID(groupID).
+		SetPriority(int(priority)).
+		SetQueueRank(queueRank).
 		SetStatusMessageIDs(statusMessageIDs).
+		SetRequesters(requesters).
 		SetStatus(string(entity.TaskStatusPending)).
-		Save(context.Background())
+		Save(ctx)
 
 	if err != nil {
 		return nil, err
@@ -53,40 +110,552 @@ func (r *TaskRepository) CreateTask(link string, groupID int64, messageID int) (
 	return &domainTask, nil
 }
 
-func (r *TaskRepository) GetNextTask() (*entity.Task, error) {
-	dbTask, err := r.database.Task.Query().
-		Where(task.Status(string(entity.TaskStatusPending))).
-		Order(ent.Asc(task.FieldID)).
-		First(context.Background())
+// ClaimNextTask atomically takes the next due pending task for the given worker.
+// Tasks are taken by priority first, then by queue rank, which interleaves the tasks of
+// different groups, and then in the order they were created. Groups that already have
+// maxTasksPerGroup tasks in progress are skipped, 0 means no limit.
+// The claim is a conditional update, so when several workers or processes share one
+// database only one of them wins a task. The claim holds until the lease expires,
+// the worker is expected to renew it with RenewLease while processing.
+func (r *TaskRepository) ClaimNextTask(ctx context.Context, workerID string, leaseDuration time.Duration, maxTasksPerGroup int) (*entity.Task, error) {
+	for {
+		isDue := isDue()
+
+		busyGroupIDs, err := r.busyGroupIDs(ctx, maxTasksPerGroup)
+		if err != nil {
+			return nil, err
+		}
+
+		query := r.database.Task.Query().Where(isDue)
+		if len(busyGroupIDs) > 0 {
+			// A task any busy group waits for would exceed its limit, whichever group created it
+			query = query.Where(task.Not(waitedForByAny(busyGroupIDs)))
+		}
+
+		candidate, err := query.
+			Order(queueOrder...).
+			First(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		count, err := r.database.Task.Update().
+			Where(task.ID(candidate.ID), isDue).
+			SetStatus(string(entity.TaskStatusInProgress)).
+			SetWorkerID(workerID).
+			SetLeaseExpiresAt(now.Add(leaseDuration)).
+			SetStartedAt(now).
+			Save(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if count == 0 {
+			// Another worker claimed this task first, try the next one
+			continue
+		}
+
+		dbTask, err := r.database.Task.Get(ctx, candidate.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		codec := r.converter.Convert()
+		domainTask := codec.Convert(*dbTask)
+		return &domainTask, nil
+	}
+}
+
+// isDue matches the pending tasks which may be claimed now
+func isDue() predicate.Task {
+	return task.And(
+		task.Status(string(entity.TaskStatusPending)),
+		task.Or(task.NextAttemptAtIsNil(), task.NextAttemptAtLTE(time.Now())),
+	)
+}
+
+// busyGroupIDs returns the groups which reached the limit of tasks in progress
+func (r *TaskRepository) busyGroupIDs(ctx context.Context, maxTasksPerGroup int) ([]int64, error) {
+	if maxTasksPerGroup <= 0 {
+		return nil, nil
+	}
+
+	counts, err := r.tasksInProgressPerGroup(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	busyGroupIDs := make([]int64, 0, len(counts))
+	for groupID, count := range counts {
+		if count >= maxTasksPerGroup {
+			busyGroupIDs = append(busyGroupIDs, groupID)
+		}
+	}
+
+	return busyGroupIDs, nil
+}
+
+// tasksInProgressPerGroup counts the tasks in progress of every group. Every group waiting
+// for a task counts it, including the groups which joined the task of another group.
+func (r *TaskRepository) tasksInProgressPerGroup(ctx context.Context) (map[int64]int, error) {
+	dbTasks, err := r.database.Task.Query().
+		Where(task.Status(string(entity.TaskStatusInProgress))).
+		Select(task.FieldGroupIDs).
+		All(ctx)
 
 	if err != nil {
 		return nil, err
 	}
 
+	// There are at most as many tasks in progress as workers, so they are counted here
+	counts := make(map[int64]int)
+	for _, dbTask := range dbTasks {
+		for _, groupID := range dbTask.GroupIDs {
+			counts[groupID]++
+		}
+	}
+
+	return counts, nil
+}
+
+// waitedForByAny matches the tasks any of the groups waits for
+func waitedForByAny(groupIDs []int64) predicate.Task {
+	return predicate.Task(func(s *sql.Selector) {
+		// Groups are stored as a JSON array
+		waitedFor := make([]*sql.Predicate, 0, len(groupIDs))
+		for _, groupID := range groupIDs {
+			waitedFor = append(waitedFor, sqljson.ValueContains(task.FieldGroupIDs, groupID))
+		}
+		s.Where(sql.Or(waitedFor...))
+	})
+}
+
+// RenewLease extends the lease of a task claimed by the given worker.
+// An error is returned when the worker does not own the task anymore.
+func (r *TaskRepository) RenewLease(ctx context.Context, id int, workerID string, leaseDuration time.Duration) error {
+	count, err := r.database.Task.Update().
+		Where(
+			task.ID(id),
+			task.Status(string(entity.TaskStatusInProgress)),
+			task.WorkerID(workerID),
+		).
+		SetLeaseExpiresAt(time.Now().Add(leaseDuration)).
+		Save(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return fmt.Errorf("task %d, worker %s: %w", id, workerID, entity.ErrTaskLeaseLost)
+	}
+
+	return nil
+}
+
+// ReclaimStaleTasks puts in-progress tasks with an expired lease back to pending, counting a failed attempt:
+// the worker may have stopped because of the task itself, which must not make it crash the workers forever.
+// A task which already used up maxRetries attempts is moved to the history as failed instead.
+// Only the tasks that were actually reclaimed or failed by this call are returned, the failed ones by the ID
+// of their history entry. Cancelled tasks whose worker is gone are moved to the history.
+func (r *TaskRepository) ReclaimStaleTasks(ctx context.Context, maxRetries int) ([]*entity.Task, map[int]*entity.Task, error) {
+	if err := r.archiveStaleCancelledTasks(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	isStale := task.And(
+		task.Status(string(entity.TaskStatusInProgress)),
+		task.Or(task.LeaseExpiresAtIsNil(), task.LeaseExpiresAtLT(time.Now())),
+	)
+
+	dbTasks, err := r.database.Task.Query().
+		Where(isStale).
+		All(ctx)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
 	codec := r.converter.Convert()
-	domainTask := codec.Convert(*dbTask)
-	return &domainTask, nil
+	reclaimed := make([]*entity.Task, 0, len(dbTasks))
+	failed := make(map[int]*entity.Task)
+
+	for _, dbTask := range dbTasks {
+		if dbTask.Attempts >= maxRetries {
+			historyID, err := r.failStaleTask(ctx, dbTask.ID, isStale)
+			if err != nil {
+				return reclaimed, failed, err
+			}
+			if historyID != 0 {
+				domainTask := codec.Convert(*dbTask)
+				domainTask.Status = entity.TaskStatusFailed
+				domainTask.Attempts++
+				domainTask.LastError = core.StaleTaskError
+				failed[historyID] = &domainTask
+			}
+			continue
+		}
+
+		// Conditional update, so a task whose lease was renewed meanwhile is left alone
+		count, err := r.database.Task.Update().
+			Where(task.ID(dbTask.ID), isStale).
+			SetStatus(string(entity.TaskStatusPending)).
+			ClearWorkerID().
+			ClearLeaseExpiresAt().
+			AddAttempts(1).
+			SetLastError(core.StaleTaskError).
+			Save(ctx)
+
+		if err != nil {
+			return reclaimed, failed, err
+		}
+
+		if count == 0 {
+			continue
+		}
+
+		domainTask := codec.Convert(*dbTask)
+		domainTask.Status = entity.TaskStatusPending
+		domainTask.WorkerID = ""
+		domainTask.LeaseExpiresAt = nil
+		domainTask.Attempts++
+		domainTask.LastError = core.StaleTaskError
+		reclaimed = append(reclaimed, &domainTask)
+	}
+
+	return reclaimed, failed, nil
+}
+
+// failStaleTask moves a stale task which used up its attempts to the history as failed.
+// Returns the ID of the history entry, 0 when the lease of the task was renewed meanwhile.
+func (r *TaskRepository) failStaleTask(ctx context.Context, id int, isStale predicate.Task) (int, error) {
+	tx, err := r.database.Tx(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := tx.Task.Update().
+		Where(task.ID(id), isStale).
+		AddAttempts(1).
+		Save(ctx)
+	if err != nil {
+		return 0, rollback(tx, err)
+	}
+	if count == 0 {
+		return 0, tx.Rollback()
+	}
+
+	dbTask, err := tx.Task.Get(ctx, id)
+	if err != nil {
+		return 0, rollback(tx, err)
+	}
+
+	outcome := entity.TaskOutcome{Status: entity.TaskStatusFailed, Error: core.StaleTaskError}
+	historyID, err := r.archiveInTx(ctx, tx, dbTask, outcome)
+	if err != nil {
+		return 0, rollback(tx, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return historyID, nil
+}
+
+// archiveStaleCancelledTasks finishes cancelled tasks whose worker is gone, see GiveUpCancelledTask
+func (r *TaskRepository) archiveStaleCancelledTasks(ctx context.Context) error {
+	isStale := task.And(
+		task.Status(string(entity.TaskStatusCancelled)),
+		task.Or(task.LeaseExpiresAtIsNil(), task.LeaseExpiresAtLT(time.Now())),
+	)
+
+	ids, err := r.database.Task.Query().
+		Where(isStale).
+		IDs(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		// A task whose worker gave it up meanwhile is left alone
+		if _, err := r.finishCancelledTask(ctx, task.ID(id), isStale); err != nil && !ent.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func (r *TaskRepository) MarkTaskInProgress(id int) error {
-	_, err := r.database.Task.UpdateOneID(id).
-		SetStatus(string(entity.TaskStatusInProgress)).
-		Save(context.Background())
+// ReleaseTask returns a task claimed by the given worker to the queue without counting
+// an attempt, e.g. when processing was interrupted by a shutdown.
+func (r *TaskRepository) ReleaseTask(ctx context.Context, id int, workerID string) error {
+	_, err := r.database.Task.Update().
+		Where(
+			task.ID(id),
+			task.Status(string(entity.TaskStatusInProgress)),
+			task.WorkerID(workerID),
+		).
+		SetStatus(string(entity.TaskStatusPending)).
+		ClearWorkerID().
+		ClearLeaseExpiresAt().
+		Save(ctx)
 	return err
 }
 
-func (r *TaskRepository) DeleteTask(id int) error {
+// ScheduleRetry returns a failed task claimed by the given worker to the queue, increasing its attempt counter.
+// The task is not claimed again until nextAttemptAt has passed. An error is returned when the worker
+// does not own the task anymore, e.g. it was reclaimed by another worker or cancelled meanwhile.
+func (r *TaskRepository) ScheduleRetry(ctx context.Context, id int, workerID string, lastError string, nextAttemptAt time.Time) error {
+	count, err := r.database.Task.Update().
+		Where(
+			task.ID(id),
+			task.Status(string(entity.TaskStatusInProgress)),
+			task.WorkerID(workerID),
+		).
+		SetStatus(string(entity.TaskStatusPending)).
+		ClearWorkerID().
+		ClearLeaseExpiresAt().
+		AddAttempts(1).
+		SetLastError(lastError).
+		SetNextAttemptAt(nextAttemptAt).
+		Save(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return fmt.Errorf("task %d, worker %s: %w", id, workerID, entity.ErrTaskLeaseLost)
+	}
+
+	return nil
+}
+
+func (r *TaskRepository) DeleteTask(ctx context.Context, id int) error {
 	_, err := r.database.Task.Delete().
 		Where(task.ID(id)).
-		Exec(context.Background())
+		Exec(ctx)
 	return err
 }
 
-func (r *TaskRepository) FindTaskByLink(link string) (*entity.Task, error) {
+// ArchiveTask moves a finished task claimed by the given worker to the task history in a single transaction.
+// A running task cancelled by its groups is still owned by its worker. Returns the ID of the history entry,
+// or an error when the worker does not own the task anymore, e.g. it was reclaimed by another worker.
+func (r *TaskRepository) ArchiveTask(ctx context.Context, id int, workerID string, outcome entity.TaskOutcome) (int, error) {
+	historyID, err := r.archive(ctx, outcome,
+		task.ID(id),
+		task.StatusIn(string(entity.TaskStatusInProgress), string(entity.TaskStatusCancelled)),
+		task.WorkerID(workerID),
+	)
+
+	if ent.IsNotFound(err) {
+		return 0, fmt.Errorf("task %d, worker %s: %w", id, workerID, entity.ErrTaskLeaseLost)
+	}
+
+	return historyID, err
+}
+
+// archive moves the task matching the predicates to the task history in a single transaction
+func (r *TaskRepository) archive(ctx context.Context, outcome entity.TaskOutcome, predicates ...predicate.Task) (int, error) {
+	for {
+		historyID, err := r.archiveOnce(ctx, outcome, predicates...)
+		if !errors.Is(err, errTaskChanged) {
+			return historyID, err
+		}
+	}
+}
+
+func (r *TaskRepository) archiveOnce(ctx context.Context, outcome entity.TaskOutcome, predicates ...predicate.Task) (int, error) {
+	tx, err := r.database.Tx(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	dbTask, err := tx.Task.Query().Where(predicates...).Only(ctx)
+	if err != nil {
+		return 0, rollback(tx, err)
+	}
+
+	historyID, err := r.archiveInTx(ctx, tx, dbTask, outcome)
+	if err != nil {
+		return 0, rollback(tx, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return historyID, nil
+}
+
+// archiveInTx writes the history entry of a task and deletes the task within the transaction.
+// The task read in the transaction is deleted, so a group added meanwhile fails the transaction.
+func (r *TaskRepository) archiveInTx(ctx context.Context, tx *ent.Tx, dbTask *ent.Task, outcome entity.TaskOutcome) (int, error) {
+	entry, err := tx.TaskHistory.Create().
+		SetLink(dbTask.Link).
+		SetMode(dbTask.Mode).
+		SetGroupIDs(dbTask.GroupIDs).
+		SetStatus(string(outcome.Status)).
+		SetPlatform(outcome.Platform).
+		SetFileSize(outcome.FileSize).
+		SetDuration(outcome.Duration).
+		SetError(outcome.Error).
+		SetAttempts(dbTask.Attempts).
+		SetNillableCreatedAt(dbTask.CreatedAt).
+		SetNillableStartedAt(dbTask.StartedAt).
+		SetFinishedAt(time.Now()).
+		Save(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := tx.Task.Delete().
+		Where(task.ID(dbTask.ID), task.Version(dbTask.Version)).
+		Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, errTaskChanged
+	}
+
+	return entry.ID, nil
+}
+
+// GetArchivedTask returns the task history entry with the given ID
+func (r *TaskRepository) GetArchivedTask(ctx context.Context, historyID int) (*entity.ArchivedTask, error) {
+	entry, err := r.database.TaskHistory.Get(ctx, historyID)
+	if err != nil {
+		return nil, err
+	}
+
+	codec := r.historyConverter.Convert()
+	archivedTask := codec.Convert(*entry)
+	return &archivedTask, nil
+}
+
+// PruneHistory removes task history entries finished before the given moment.
+func (r *TaskRepository) PruneHistory(ctx context.Context, finishedBefore time.Time) (int, error) {
+	return r.database.TaskHistory.Delete().
+		Where(taskhistory.FinishedAtLT(finishedBefore)).
+		Exec(ctx)
+}
+
+// ListPendingTasks returns the pending tasks in the order workers take them. The tasks due now come first
+// in the order of ClaimNextTask, those which can't be claimed while a group they wait for has maxTasksPerGroup
+// tasks in progress after the others, assuming the tasks ahead are claimed too. The tasks waiting to be retried
+// follow by the time they are due.
+func (r *TaskRepository) ListPendingTasks(ctx context.Context, maxTasksPerGroup int) ([]*entity.Task, error) {
+	dueTasks, err := r.database.Task.Query().
+		Where(isDue()).
+		Order(queueOrder...).
+		All(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	retriedTasks, err := r.database.Task.Query().
+		Where(
+			task.Status(string(entity.TaskStatusPending)),
+			task.NextAttemptAtGT(time.Now()),
+		).
+		Order(append([]task.OrderOption{ent.Asc(task.FieldNextAttemptAt)}, queueOrder...)...).
+		All(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if maxTasksPerGroup > 0 {
+		counts, err := r.tasksInProgressPerGroup(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		claimable := make([]*ent.Task, 0, len(dueTasks))
+		blocked := make([]*ent.Task, 0)
+		for _, dbTask := range dueTasks {
+			if slices.ContainsFunc(dbTask.GroupIDs, func(groupID int64) bool { return counts[groupID] >= maxTasksPerGroup }) {
+				blocked = append(blocked, dbTask)
+				continue
+			}
+			claimable = append(claimable, dbTask)
+			for _, groupID := range dbTask.GroupIDs {
+				counts[groupID]++
+			}
+		}
+		dueTasks = append(claimable, blocked...)
+	}
+
+	codec := r.converter.Convert()
+	tasks := make([]*entity.Task, 0, len(dueTasks)+len(retriedTasks))
+	for _, dbTask := range append(dueTasks, retriedTasks...) {
+		domainTask := codec.Convert(*dbTask)
+		tasks = append(tasks, &domainTask)
+	}
+
+	return tasks, nil
+}
+
+// AverageProcessingTime returns the average time the latest completed tasks took from
+// the start of their last attempt until they were finished, 0 if there is no history yet.
+func (r *TaskRepository) AverageProcessingTime(ctx context.Context, sampleSize int) (time.Duration, error) {
+	entries, err := r.database.TaskHistory.Query().
+		Where(
+			taskhistory.Status(string(entity.TaskStatusCompleted)),
+			taskhistory.StartedAtNotNil(),
+		).
+		Order(ent.Desc(taskhistory.FieldFinishedAt)).
+		Limit(sampleSize).
+		All(ctx)
+
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+
+	var total time.Duration
+	for _, entry := range entries {
+		total += entry.FinishedAt.Sub(*entry.StartedAt)
+	}
+
+	return total / time.Duration(len(entries)), nil
+}
+
+func (r *TaskRepository) GetTask(ctx context.Context, id int) (*entity.Task, error) {
+	dbTask, err := r.database.Task.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	codec := r.converter.Convert()
+	domainTask := codec.Convert(*dbTask)
+	return &domainTask, nil
+}
+
+// FindTaskByStatusMessage finds the queued or running task whose status message in the group has the given ID,
+// including a cancelled task requested again before its worker gave it up.
+// Returns entity.ErrTaskNotFound when there is no such task.
+func (r *TaskRepository) FindTaskByStatusMessage(ctx context.Context, groupID int64, messageID int) (*entity.Task, error) {
+	// Status messages are stored as a JSON object keyed by the group ID
+	groupKey := strconv.Quote(strconv.FormatInt(groupID, 10))
+	hasStatusMessage := predicate.Task(func(s *sql.Selector) {
+		s.Where(sqljson.ValueEQ(task.FieldStatusMessageIDs, messageID, sqljson.Path(groupKey)))
+	})
+
 	dbTask, err := r.database.Task.Query().
-		Where(task.Link(link)).
-		First(context.Background())
+		Where(
+			task.StatusIn(string(entity.TaskStatusPending), string(entity.TaskStatusInProgress), string(entity.TaskStatusCancelled)),
+			hasStatusMessage,
+		).
+		First(ctx)
 
+	if ent.IsNotFound(err) {
+		return nil, fmt.Errorf("status message %d in group %d: %w", messageID, groupID, entity.ErrTaskNotFound)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -96,35 +665,208 @@ func (r *TaskRepository) FindTaskByLink(link string) (*entity.Task, error) {
 	return &domainTask, nil
 }
 
-func (r *TaskRepository) AddGroupToTask(taskID int, groupID int64, messageID int) error {
-	// Get current task
-	dbTask, err := r.database.Task.Get(context.Background(), taskID)
+// RemoveGroupFromTask stops a task from being delivered to the group.
+// When no groups are left the task is cancelled: a pending task is moved to the history
+// right away, an in-progress task is marked cancelled for its worker to abort.
+func (r *TaskRepository) RemoveGroupFromTask(ctx context.Context, taskID int, groupID int64) (*entity.Task, error) {
+	for {
+		removed, err := r.removeGroupFromTask(ctx, taskID, groupID)
+		if !errors.Is(err, errTaskChanged) {
+			return removed, err
+		}
+	}
+}
+
+// removeGroupFromTask removes the group in a single transaction, errTaskChanged is returned
+// when the groups of the task were changed meanwhile
+func (r *TaskRepository) removeGroupFromTask(ctx context.Context, taskID int, groupID int64) (*entity.Task, error) {
+	tx, err := r.database.Tx(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Check if group already exists
+	dbTask, err := tx.Task.Get(ctx, taskID)
+	if err != nil {
+		return nil, rollback(tx, err)
+	}
+
+	updatedGroupIDs := make([]int64, 0, len(dbTask.GroupIDs))
 	for _, existingGroupID := range dbTask.GroupIDs {
-		if existingGroupID == groupID {
-			return nil // Group already exists, no need to add
+		if existingGroupID != groupID {
+			updatedGroupIDs = append(updatedGroupIDs, existingGroupID)
 		}
 	}
 
-	// Add new group ID
-	updatedGroupIDs := append(dbTask.GroupIDs, groupID)
+	if len(updatedGroupIDs) == len(dbTask.GroupIDs) {
+		return nil, rollback(tx, fmt.Errorf("group %d is not waiting for task %d", groupID, taskID))
+	}
 
-	// Update statusMessageIDs map
 	updatedStatusMessageIDs := dbTask.StatusMessageIDs
-	if updatedStatusMessageIDs == nil {
-		updatedStatusMessageIDs = make(map[int64]int)
-	}
-	updatedStatusMessageIDs[groupID] = messageID
+	delete(updatedStatusMessageIDs, groupID)
+	updatedRequesters := dbTask.Requesters
+	delete(updatedRequesters, groupID)
 
-	// Update task with new group IDs and statusMessageIDs
-	_, err = r.database.Task.UpdateOneID(taskID).
+	// Conditional update, so a group added or removed meanwhile is not lost
+	update := tx.Task.Update().
+		Where(task.ID(taskID), task.Version(dbTask.Version)).
 		SetGroupIDs(updatedGroupIDs).
 		SetStatusMessageIDs(updatedStatusMessageIDs).
-		Save(context.Background())
+		SetRequesters(updatedRequesters).
+		AddVersion(1)
+
+	// A running task is aborted by its worker, a task cancelled before is left to it
+	if len(updatedGroupIDs) == 0 && dbTask.Status == string(entity.TaskStatusInProgress) {
+		update = update.SetStatus(string(entity.TaskStatusCancelled))
+	}
+
+	count, err := update.Save(ctx)
+	if err != nil {
+		return nil, rollback(tx, err)
+	}
+	if count == 0 {
+		return nil, rollback(tx, errTaskChanged)
+	}
+
+	updatedTask, err := tx.Task.Get(ctx, taskID)
+	if err != nil {
+		return nil, rollback(tx, err)
+	}
+
+	codec := r.converter.Convert()
+	domainTask := codec.Convert(*updatedTask)
+
+	if len(updatedGroupIDs) == 0 && dbTask.Status == string(entity.TaskStatusPending) {
+		// Nobody has started the task yet, so it goes straight to the history
+		outcome := entity.TaskOutcome{Status: entity.TaskStatusCancelled}
+		if _, err := r.archiveInTx(ctx, tx, updatedTask, outcome); err != nil {
+			return nil, rollback(tx, err)
+		}
+		domainTask.Status = entity.TaskStatusCancelled
+	}
+
+	return &domainTask, tx.Commit()
+}
+
+func (r *TaskRepository) FindTaskByLink(ctx context.Context, link string, mode entity.TaskMode) (*entity.Task, error) {
+	dbTask, err := r.database.Task.Query().
+		Where(task.Link(link), task.Mode(string(mode))).
+		First(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	codec := r.converter.Convert()
+	domainTask := codec.Convert(*dbTask)
+	return &domainTask, nil
+}
+
+// AddGroupToTask adds the group to the groups waiting for the task. A running task cancelled by its groups
+// keeps its status until its worker gives it up, see GiveUpCancelledTask, and is queued again then,
+// so the same link is never processed by two workers.
+func (r *TaskRepository) AddGroupToTask(ctx context.Context, taskID int, groupID int64, messageID int, requester string) error {
+	for {
+		dbTask, err := r.database.Task.Get(ctx, taskID)
+		if err != nil {
+			return err
+		}
 
+		if slices.Contains(dbTask.GroupIDs, groupID) {
+			return nil // Group already exists, no need to add
+		}
+
+		updatedGroupIDs := append(dbTask.GroupIDs, groupID)
+
+		updatedStatusMessageIDs := dbTask.StatusMessageIDs
+		if updatedStatusMessageIDs == nil {
+			updatedStatusMessageIDs = make(map[int64]int)
+		}
+		updatedStatusMessageIDs[groupID] = messageID
+
+		updatedRequesters := dbTask.Requesters
+		if updatedRequesters == nil {
+			updatedRequesters = make(map[int64]string)
+		}
+		updatedRequesters[groupID] = requester
+
+		// Conditional update, so a group added or removed meanwhile is not lost
+		count, err := r.database.Task.Update().
+			Where(task.ID(taskID), task.Version(dbTask.Version)).
+			SetGroupIDs(updatedGroupIDs).
+			SetStatusMessageIDs(updatedStatusMessageIDs).
+			SetRequesters(updatedRequesters).
+			AddVersion(1).
+			Save(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		if count > 0 {
+			return nil
+		}
+		// The groups were changed meanwhile, try again with the current ones
+	}
+}
+
+// GiveUpCancelledTask is called by the worker of a running task cancelled by its groups once it stopped
+// processing the task. The task is moved to the history, unless a group requested it again meanwhile,
+// then it is put back to the queue. Returns whether the task was queued again, or entity.ErrTaskLeaseLost
+// when the task is not a cancelled task of the worker.
+func (r *TaskRepository) GiveUpCancelledTask(ctx context.Context, id int, workerID string) (bool, error) {
+	requeued, err := r.finishCancelledTask(ctx,
+		task.ID(id),
+		task.Status(string(entity.TaskStatusCancelled)),
+		task.WorkerID(workerID),
+	)
+
+	if ent.IsNotFound(err) {
+		return false, fmt.Errorf("task %d, worker %s: %w", id, workerID, entity.ErrTaskLeaseLost)
+	}
+
+	return requeued, err
+}
+
+// finishCancelledTask moves the cancelled task matching the predicates to the history,
+// or back to the queue when a group requested it again
+func (r *TaskRepository) finishCancelledTask(ctx context.Context, predicates ...predicate.Task) (bool, error) {
+	for {
+		dbTask, err := r.database.Task.Query().Where(predicates...).Only(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		if len(dbTask.GroupIDs) == 0 {
+			outcome := entity.TaskOutcome{Status: entity.TaskStatusCancelled}
+			_, err := r.archive(ctx, outcome, append(predicates, task.Version(dbTask.Version))...)
+			if ent.IsNotFound(err) {
+				// A group requested the task meanwhile
+				continue
+			}
+			return false, err
+		}
+
+		count, err := r.database.Task.Update().
+			Where(append(predicates, task.Version(dbTask.Version))...).
+			SetStatus(string(entity.TaskStatusPending)).
+			ClearWorkerID().
+			ClearLeaseExpiresAt().
+			Save(ctx)
+
+		if err != nil {
+			return false, err
+		}
+
+		if count > 0 {
+			return true, nil
+		}
+	}
+}
+
+// rollback aborts the transaction and returns the error that caused it
+func rollback(tx *ent.Tx, err error) error {
+	if rollbackErr := tx.Rollback(); rollbackErr != nil {
+		return fmt.Errorf("%w: rollback failed: %v", err, rollbackErr)
+	}
 	return err
 }
\ No newline at end of file
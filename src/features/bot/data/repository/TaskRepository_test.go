@@ -0,0 +1,289 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"tg-downloader/ent"
+	"tg-downloader/ent/enttest"
+	"tg-downloader/src/core"
+	"tg-downloader/src/features/bot/domain/entity"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const testLeaseDuration = time.Minute
+
+// newTestTaskRepository returns a repository backed by an in-memory database of its own
+func newTestTaskRepository(t *testing.T) *TaskRepository {
+	t.Helper()
+
+	name := strings.ReplaceAll(t.Name(), "/", "_")
+	client := enttest.Open(t, "sqlite3", fmt.Sprintf("file:%s?mode=memory&cache=shared&_fk=1", name))
+	t.Cleanup(func() { client.Close() })
+
+	return NewTaskRepository(client).(*TaskRepository)
+}
+
+func createTestTask(t *testing.T, repo *TaskRepository, link string, groupID int64, priority entity.TaskPriority) *entity.Task {
+	t.Helper()
+
+	created, err := repo.CreateTask(context.Background(), link, entity.TaskModeVideo, groupID, 1, "user", priority)
+	if err != nil {
+		t.Fatalf("failed to create task %s: %v", link, err)
+	}
+	return created
+}
+
+// startTestTask puts the task in progress for another worker, as if it had claimed it
+func startTestTask(t *testing.T, repo *TaskRepository, id int, leaseExpiresAt time.Time) {
+	t.Helper()
+
+	err := repo.database.Task.UpdateOneID(id).
+		SetStatus(string(entity.TaskStatusInProgress)).
+		SetWorkerID("other").
+		SetLeaseExpiresAt(leaseExpiresAt).
+		SetStartedAt(time.Now()).
+		Exec(context.Background())
+	if err != nil {
+		t.Fatalf("failed to start task %d: %v", id, err)
+	}
+}
+
+func TestClaimNextTask(t *testing.T) {
+	tests := []struct {
+		name             string
+		maxTasksPerGroup int
+		setup            func(t *testing.T, repo *TaskRepository)
+		wantLinks        []string // links in the order they are claimed until none is left
+	}{
+		{
+			name: "priority first",
+			setup: func(t *testing.T, repo *TaskRepository) {
+				createTestTask(t, repo, "normal", 1, entity.TaskPriorityNormal)
+				createTestTask(t, repo, "admin", 2, entity.TaskPriorityAdmin)
+			},
+			wantLinks: []string{"admin", "normal"},
+		},
+		{
+			name: "groups interleaved by queue rank",
+			setup: func(t *testing.T, repo *TaskRepository) {
+				createTestTask(t, repo, "a1", 1, entity.TaskPriorityNormal)
+				createTestTask(t, repo, "a2", 1, entity.TaskPriorityNormal)
+				createTestTask(t, repo, "b1", 2, entity.TaskPriorityNormal)
+			},
+			wantLinks: []string{"a1", "b1", "a2"},
+		},
+		{
+			name: "retry not due yet",
+			setup: func(t *testing.T, repo *TaskRepository) {
+				waiting := createTestTask(t, repo, "waiting", 1, entity.TaskPriorityNormal)
+				createTestTask(t, repo, "due", 2, entity.TaskPriorityNormal)
+				err := repo.database.Task.UpdateOneID(waiting.ID).
+					SetNextAttemptAt(time.Now().Add(time.Hour)).
+					Exec(context.Background())
+				if err != nil {
+					t.Fatalf("failed to postpone task: %v", err)
+				}
+			},
+			wantLinks: []string{"due"},
+		},
+		{
+			name:             "busy group skipped",
+			maxTasksPerGroup: 1,
+			setup: func(t *testing.T, repo *TaskRepository) {
+				running := createTestTask(t, repo, "a1", 1, entity.TaskPriorityNormal)
+				createTestTask(t, repo, "a2", 1, entity.TaskPriorityAdmin)
+				createTestTask(t, repo, "b1", 2, entity.TaskPriorityNormal)
+				startTestTask(t, repo, running.ID, time.Now().Add(time.Hour))
+			},
+			wantLinks: []string{"b1"},
+		},
+		{
+			name:             "task joined by busy group skipped",
+			maxTasksPerGroup: 1,
+			setup: func(t *testing.T, repo *TaskRepository) {
+				running := createTestTask(t, repo, "a1", 1, entity.TaskPriorityNormal)
+				createTestTask(t, repo, "b1", 2, entity.TaskPriorityAdmin)
+				createTestTask(t, repo, "b1", 1, entity.TaskPriorityNormal)
+				createTestTask(t, repo, "c1", 3, entity.TaskPriorityNormal)
+				startTestTask(t, repo, running.ID, time.Now().Add(time.Hour))
+			},
+			wantLinks: []string{"c1"},
+		},
+		{
+			name:             "no limit",
+			maxTasksPerGroup: 0,
+			setup: func(t *testing.T, repo *TaskRepository) {
+				running := createTestTask(t, repo, "a1", 1, entity.TaskPriorityNormal)
+				createTestTask(t, repo, "a2", 1, entity.TaskPriorityNormal)
+				startTestTask(t, repo, running.ID, time.Now().Add(time.Hour))
+			},
+			wantLinks: []string{"a2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := newTestTaskRepository(t)
+			test.setup(t, repo)
+
+			var claimedLinks []string
+			for {
+				claimed, err := repo.ClaimNextTask(context.Background(), "worker", testLeaseDuration, test.maxTasksPerGroup)
+				if ent.IsNotFound(err) {
+					break
+				}
+				if err != nil {
+					t.Fatalf("failed to claim a task: %v", err)
+				}
+				if claimed.Status != entity.TaskStatusInProgress || claimed.WorkerID != "worker" || claimed.LeaseExpiresAt == nil {
+					t.Fatalf("expected task %s to be claimed by the worker, got %+v", claimed.Link, claimed)
+				}
+				claimedLinks = append(claimedLinks, claimed.Link)
+				if len(claimedLinks) > len(test.wantLinks) {
+					break
+				}
+			}
+
+			if strings.Join(claimedLinks, ",") != strings.Join(test.wantLinks, ",") {
+				t.Fatalf("expected the tasks %v to be claimed, got %v", test.wantLinks, claimedLinks)
+			}
+		})
+	}
+}
+
+func TestReclaimStaleTasks(t *testing.T) {
+	const maxRetries = 3
+
+	tests := []struct {
+		name          string
+		attempts      int
+		leaseExpired  bool
+		wantReclaimed bool
+		wantFailed    bool
+	}{
+		{name: "first attempt", attempts: 0, leaseExpired: true, wantReclaimed: true},
+		{name: "last attempt left", attempts: maxRetries - 1, leaseExpired: true, wantReclaimed: true},
+		{name: "attempts used up", attempts: maxRetries, leaseExpired: true, wantFailed: true},
+		{name: "lease not expired", attempts: maxRetries, leaseExpired: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			repo := newTestTaskRepository(t)
+
+			created := createTestTask(t, repo, "link", 1, entity.TaskPriorityNormal)
+			leaseExpiresAt := time.Now().Add(time.Hour)
+			if test.leaseExpired {
+				leaseExpiresAt = time.Now().Add(-time.Second)
+			}
+			startTestTask(t, repo, created.ID, leaseExpiresAt)
+			if err := repo.database.Task.UpdateOneID(created.ID).SetAttempts(test.attempts).Exec(ctx); err != nil {
+				t.Fatalf("failed to set attempts: %v", err)
+			}
+
+			reclaimed, failed, err := repo.ReclaimStaleTasks(ctx, maxRetries)
+			if err != nil {
+				t.Fatalf("failed to reclaim tasks: %v", err)
+			}
+			if (len(reclaimed) == 1) != test.wantReclaimed || (len(failed) == 1) != test.wantFailed {
+				t.Fatalf("expected reclaimed %t and failed %t, got %d reclaimed and %d failed",
+					test.wantReclaimed, test.wantFailed, len(reclaimed), len(failed))
+			}
+
+			stored, err := repo.GetTask(ctx, created.ID)
+			switch {
+			case test.wantFailed:
+				if !ent.IsNotFound(err) {
+					t.Fatalf("expected the failed task to be removed from the queue, got %v", err)
+				}
+				for historyID := range failed {
+					archived, err := repo.GetArchivedTask(ctx, historyID)
+					if err != nil {
+						t.Fatalf("expected the failed task in the history: %v", err)
+					}
+					if archived.Outcome.Status != entity.TaskStatusFailed || archived.Outcome.Error != core.StaleTaskError {
+						t.Fatalf("expected the task to be archived as stale, got %+v", archived.Outcome)
+					}
+				}
+			case test.wantReclaimed:
+				if err != nil {
+					t.Fatalf("expected the task to stay queued: %v", err)
+				}
+				if stored.Status != entity.TaskStatusPending || stored.WorkerID != "" || stored.Attempts != test.attempts+1 {
+					t.Fatalf("expected the task back in the queue with a failed attempt, got %+v", stored)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("expected the task to stay queued: %v", err)
+				}
+				if stored.Status != entity.TaskStatusInProgress || stored.Attempts != test.attempts {
+					t.Fatalf("expected the task with a valid lease to be left alone, got %+v", stored)
+				}
+			}
+		})
+	}
+}
+
+func TestFinishingReclaimedTaskLosesLease(t *testing.T) {
+	tests := []struct {
+		name         string
+		claimedAgain bool // another worker claimed the task after it was reclaimed
+	}{
+		{name: "reclaimed", claimedAgain: false},
+		{name: "claimed by another worker", claimedAgain: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			repo := newTestTaskRepository(t)
+
+			created := createTestTask(t, repo, "link", 1, entity.TaskPriorityNormal)
+			claimed, err := repo.ClaimNextTask(ctx, "stalled", testLeaseDuration, 0)
+			if err != nil {
+				t.Fatalf("failed to claim the task: %v", err)
+			}
+
+			// The worker stalls past its lease and the task is reclaimed
+			err = repo.database.Task.UpdateOneID(created.ID).
+				SetLeaseExpiresAt(time.Now().Add(-time.Second)).
+				Exec(ctx)
+			if err != nil {
+				t.Fatalf("failed to expire the lease: %v", err)
+			}
+			if _, _, err := repo.ReclaimStaleTasks(ctx, 3); err != nil {
+				t.Fatalf("failed to reclaim tasks: %v", err)
+			}
+			wantStatus, wantWorker := entity.TaskStatusPending, ""
+			if test.claimedAgain {
+				if _, err := repo.ClaimNextTask(ctx, "next", testLeaseDuration, 0); err != nil {
+					t.Fatalf("failed to claim the task again: %v", err)
+				}
+				wantStatus, wantWorker = entity.TaskStatusInProgress, "next"
+			}
+
+			err = repo.ScheduleRetry(ctx, claimed.ID, "stalled", "download failed", time.Now().Add(time.Minute))
+			if !errors.Is(err, entity.ErrTaskLeaseLost) {
+				t.Fatalf("expected the retry to lose the lease, got %v", err)
+			}
+			_, err = repo.ArchiveTask(ctx, claimed.ID, "stalled", entity.TaskOutcome{Status: entity.TaskStatusCompleted})
+			if !errors.Is(err, entity.ErrTaskLeaseLost) {
+				t.Fatalf("expected the archive to lose the lease, got %v", err)
+			}
+
+			stored, err := repo.GetTask(ctx, created.ID)
+			if err != nil {
+				t.Fatalf("expected the task to stay queued: %v", err)
+			}
+			if stored.Status != wantStatus || stored.WorkerID != wantWorker || stored.Attempts != 1 || stored.NextAttemptAt != nil {
+				t.Fatalf("expected the task to be left to the queue, got %+v", stored)
+			}
+		})
+	}
+}
\ No newline at end of file
@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"tg-downloader/env"
+	"tg-downloader/src/core"
+	"tg-downloader/src/core/logger"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// WebhookServer receives the updates Telegram posts to the webhook, an alternative to long polling.
+// The updates are handed over on the same kind of channel polling delivers them on.
+type WebhookServer struct {
+	config  env.WebhookConfiguration
+	botApi  *tgbotapi.BotAPI
+	server  *http.Server
+	updates chan tgbotapi.Update
+	logger  *logger.Logger
+}
+
+func NewWebhookServer(config env.WebhookConfiguration, botApi *tgbotapi.BotAPI, logger *logger.Logger) *WebhookServer {
+	webhook := &WebhookServer{
+		config:  config,
+		botApi:  botApi,
+		updates: make(chan tgbotapi.Update, core.WebhookUpdateBuffer),
+		logger:  logger,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(config.Path, webhook)
+	webhook.server = &http.Server{
+		Addr:              config.ListenAddress,
+		Handler:           mux,
+		ReadHeaderTimeout: core.WebhookReadHeaderTimeout,
+	}
+
+	return webhook
+}
+
+// Updates returns the channel the received updates are delivered on, it is closed when the server stops
+func (s *WebhookServer) Updates() tgbotapi.UpdatesChannel {
+	return s.updates
+}
+
+// Start starts listening and registers the webhook with Telegram, which then stops answering getUpdates
+func (s *WebhookServer) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.config.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("failed to listen for webhook updates: %w", err)
+	}
+
+	go func() {
+		var err error
+		if s.config.TlsCertificateFile != nil && s.config.TlsKeyFile != nil {
+			err = s.server.ServeTLS(listener, *s.config.TlsCertificateFile, *s.config.TlsKeyFile)
+		} else {
+			err = s.server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error(fmt.Sprintf("Webhook server failed: %v", err))
+		}
+	}()
+
+	if err := s.setWebhook(); err != nil {
+		s.server.Close()
+		return fmt.Errorf("failed to set webhook: %w", err)
+	}
+
+	s.logger.Info(fmt.Sprintf("Receiving updates by webhook on %s%s", s.config.ListenAddress, s.config.Path))
+	return nil
+}
+
+// Stop removes the webhook and waits for the requests being handled. Updates sent meanwhile are kept
+// by Telegram and delivered once the webhook is set again.
+func (s *WebhookServer) Stop(ctx context.Context) error {
+	_, deleteErr := s.botApi.Request(tgbotapi.DeleteWebhookConfig{})
+	if deleteErr != nil {
+		s.logger.Warn(fmt.Sprintf("Failed to delete webhook: %v", deleteErr))
+	}
+
+	// Handlers still running after a failed shutdown may write to the channel, so it stays open then
+	if err := s.server.Shutdown(ctx); err != nil {
+		return err
+	}
+	close(s.updates)
+	return nil
+}
+
+// ServeHTTP accepts an update posted by Telegram. Requests without the secret token are rejected,
+// anyone who guessed the URL could post fake updates otherwise.
+func (s *WebhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	secretToken := r.Header.Get(core.WebhookSecretTokenHeader)
+	if subtle.ConstantTimeCompare([]byte(secretToken), []byte(s.config.SecretToken)) != 1 {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var update tgbotapi.Update
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, core.WebhookMaxBodyBytes)).Decode(&update); err != nil {
+		http.Error(w, "invalid update", http.StatusBadRequest)
+		return
+	}
+
+	// Telegram delivers the update again later when it is not accepted in time
+	select {
+	case s.updates <- update:
+		w.WriteHeader(http.StatusOK)
+	case <-r.Context().Done():
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}
+}
+
+// setWebhook registers the webhook. tgbotapi does not support the secret token, so the request is built here.
+func (s *WebhookServer) setWebhook() error {
+	allowedUpdates, err := json.Marshal(core.BotAllowedUpdates)
+	if err != nil {
+		return err
+	}
+
+	params := tgbotapi.Params{}
+	params.AddNonEmpty("url", s.config.Url)
+	params.AddNonEmpty("secret_token", s.config.SecretToken)
+	params.AddNonEmpty("allowed_updates", string(allowedUpdates))
+	params.AddNonEmpty("max_connections", strconv.Itoa(s.config.MaxConnections))
+
+	if s.config.UploadCertificate && s.config.TlsCertificateFile != nil {
+		certificate := tgbotapi.RequestFile{Name: "certificate", Data: tgbotapi.FilePath(*s.config.TlsCertificateFile)}
+		_, err = s.botApi.UploadFiles("setWebhook", params, []tgbotapi.RequestFile{certificate})
+		return err
+	}
+
+	_, err = s.botApi.MakeRequest("setWebhook", params)
+	return err
+}
\ No newline at end of file
@@ -0,0 +1,123 @@
+package repository
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"tg-downloader/env"
+	"tg-downloader/src/core"
+	"tg-downloader/src/core/logger"
+	"tg-downloader/src/features/bot/domain/entity"
+	"time"
+)
+
+const testSecretToken = "secret_token-1"
+
+func newTestWebhookServer() *WebhookServer {
+	return NewWebhookServer(env.WebhookConfiguration{
+		Url:            "https://bot.example.com/telegram/webhook",
+		ListenAddress:  ":0",
+		Path:           "/telegram/webhook",
+		SecretToken:    testSecretToken,
+		MaxConnections: 40,
+	}, nil, nil)
+}
+
+func postUpdate(server *WebhookServer, secretToken string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/telegram/webhook", strings.NewReader(body))
+	if secretToken != "" {
+		request.Header.Set(core.WebhookSecretTokenHeader, secretToken)
+	}
+
+	recorder := httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestWebhookRejectsRequests(t *testing.T) {
+	tests := []struct {
+		name        string
+		secretToken string
+		body        string
+		status      int
+	}{
+		{"missing secret token", "", `{"update_id":1}`, http.StatusForbidden},
+		{"wrong secret token", "other-secret", `{"update_id":1}`, http.StatusForbidden},
+		{"malformed body", testSecretToken, `{"update_id":`, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestWebhookServer()
+
+			recorder := postUpdate(server, test.secretToken, test.body)
+			if recorder.Code != test.status {
+				t.Fatalf("expected status %d, got %d", test.status, recorder.Code)
+			}
+			if pending := len(server.updates); pending != 0 {
+				t.Fatalf("expected no update to be delivered, got %d", pending)
+			}
+		})
+	}
+}
+
+func TestWebhookRejectsOtherMethods(t *testing.T) {
+	server := newTestWebhookServer()
+
+	request := httptest.NewRequest(http.MethodGet, "/telegram/webhook", nil)
+	request.Header.Set(core.WebhookSecretTokenHeader, testSecretToken)
+	recorder := httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status %d, got %d", http.StatusMethodNotAllowed, recorder.Code)
+	}
+}
+
+func TestWebhookUpdateIsReceivedAsEvent(t *testing.T) {
+	server := newTestWebhookServer()
+
+	environment := env.TGDownloader{
+		TelegramConfiguration: env.TelegramConfiguration{
+			TgBotApiKey: "123:token",
+			UpdateLimit: 10,
+			BotName:     "downloader_bot",
+		},
+		CommandConfiguration: env.CommandConfiguration{
+			Commands: map[string]env.Command{
+				core.LoadResourceKey:      {Command: "/l"},
+				core.LoadAudioResourceKey: {Command: "/la"},
+			},
+		},
+	}
+	repo := NewBotRepository(environment, nil, nil, server, logger.NewLogger(nil))
+	events := repo.ReceiveEvents()
+
+	update := `{
+		"update_id": 7,
+		"message": {
+			"message_id": 3,
+			"date": 1700000000,
+			"text": "/l@downloader_bot https://www.tiktok.com/@user/video/1",
+			"chat": {"id": -100200300, "type": "supergroup", "title": "Group"},
+			"from": {"id": 42, "is_bot": false, "first_name": "User", "username": "user"}
+		}
+	}`
+	if recorder := postUpdate(server, testSecretToken, update); recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	select {
+	case event := <-events:
+		resource, ok := event.(entity.GetResource)
+		if !ok {
+			t.Fatalf("expected a GetResource event, got %#v", event)
+		}
+		if resource.GroupID != -100200300 || resource.UserName != "user" || resource.Link != "https://www.tiktok.com/@user/video/1" {
+			t.Fatalf("unexpected event %#v", resource)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the update was not received as an event")
+	}
+}
\ No newline at end of file
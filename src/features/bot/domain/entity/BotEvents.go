@@ -78,12 +78,27 @@ func (StartBot) isBotEvent() {}
 
 // GetResource event for requesting a resource
 type GetResource struct {
-	GroupID int64
-	Link    string
+	GroupID  int64
+	UserID   int64
+	UserName string
+	Link     string
+	Mode     TaskMode
 }
 
 func (GetResource) isBotEvent() {}
 
+// CancelResource event for cancelling a requested resource,
+// identified either by its status message or by its link
+type CancelResource struct {
+	GroupID   int64
+	UserID    int64
+	UserName  string
+	MessageID int // status message the command replied to, 0 if none
+	Link      string
+}
+
+func (CancelResource) isBotEvent() {}
+
 // ErrorDirect event for direct user errors
 type ErrorDirect struct {
 	UserID   int64
@@ -110,3 +125,60 @@ type IgnoreCommand struct {
 }
 
 func (IgnoreCommand) isBotEvent() {}
+
+// ButtonPress describes a pressed inline keyboard button, Telegram expects every press to be answered
+type ButtonPress struct {
+	CallbackQueryID string
+	UserID          int64
+	UserName        string
+	ChatID          int64 // chat of the message the button is attached to
+	MessageID       int   // message the button is attached to
+}
+
+// CancelResourcePressed event for the cancel button of a status message
+type CancelResourcePressed struct {
+	ButtonPress
+}
+
+func (CancelResourcePressed) isBotEvent() {}
+
+// RetryResourcePressed event for the retry button of a failed download
+type RetryResourcePressed struct {
+	ButtonPress
+	HistoryID int // task history entry of the failed download
+}
+
+func (RetryResourcePressed) isBotEvent() {}
+
+// GroupsPagePressed event for a button showing another page of the admin group list
+type GroupsPagePressed struct {
+	ButtonPress
+	Page int
+}
+
+func (GroupsPagePressed) isBotEvent() {}
+
+// DeleteGroupPressed event for the delete button of a group in the admin group list, asks for confirmation
+type DeleteGroupPressed struct {
+	ButtonPress
+	GroupID int64
+	Page    int // page of the group list to return to
+}
+
+func (DeleteGroupPressed) isBotEvent() {}
+
+// DeleteGroupConfirmed event for the button confirming a group deletion
+type DeleteGroupConfirmed struct {
+	ButtonPress
+	GroupID int64
+	Page    int // page of the group list to return to
+}
+
+func (DeleteGroupConfirmed) isBotEvent() {}
+
+// InvalidButtonPressed event for a button whose data is unknown or not signed by the bot
+type InvalidButtonPressed struct {
+	ButtonPress
+}
+
+func (InvalidButtonPressed) isBotEvent() {}
\ No newline at end of file
@@ -0,0 +1,28 @@
+package entity
+
+// CallbackAction tells what pressing an inline keyboard button does
+type CallbackAction byte
+
+const (
+	CallbackActionCancelResource     CallbackAction = iota + 1 // cancel the download of the status message
+	CallbackActionRetryResource                                // download the link of a failed task again, args: history entry ID
+	CallbackActionGroupsPage                                   // show a page of the admin group list, args: page
+	CallbackActionDeleteGroup                                  // ask to confirm deleting a group, args: group ID, page
+	CallbackActionConfirmDeleteGroup                           // delete a group, args: group ID, page
+)
+
+// CallbackData is carried by an inline keyboard button and returned by Telegram when the button is pressed.
+// It is signed when sent, so a user can't make up the data of an admin action.
+type CallbackData struct {
+	Action CallbackAction
+	Args   []int64
+}
+
+// InlineButton is a button attached to a message
+type InlineButton struct {
+	Text string
+	Data CallbackData
+}
+
+// InlineKeyboard holds the rows of buttons attached to a message
+type InlineKeyboard [][]InlineButton
\ No newline at end of file
@@ -1,5 +1,10 @@
 package entity
 
+import (
+	"errors"
+	"time"
+)
+
 // TaskStatus represents the current state of a task
 type TaskStatus string
 
@@ -8,13 +13,67 @@ const (
 	TaskStatusInProgress TaskStatus = "in_progress"
 	TaskStatusCompleted  TaskStatus = "completed"
 	TaskStatusFailed     TaskStatus = "failed"
+	TaskStatusCancelled  TaskStatus = "cancelled"
+)
+
+// TaskPriority orders tasks in the queue, tasks with a higher priority are processed first
+type TaskPriority int
+
+const (
+	TaskPriorityNormal TaskPriority = 0
+	TaskPriorityAdmin  TaskPriority = 1
+)
+
+// TaskMode tells what is downloaded for the link of a task
+type TaskMode string
+
+const (
+	TaskModeVideo TaskMode = "video"
+	TaskModeAudio TaskMode = "audio" // only the audio track, sent as a Telegram audio
 )
 
+// ErrTaskLeaseLost is returned when a worker tries to renew the lease of, retry or archive a task it does not
+// own anymore, e.g. because the task was cancelled or reclaimed by another worker
+var ErrTaskLeaseLost = errors.New("task lease lost")
+
+// ErrTaskNotFound is returned when no queued or running task matches the lookup
+var ErrTaskNotFound = errors.New("task not found")
+
 // Task represents a video processing task
 type Task struct {
 	ID               int
 	Link             string
+	Mode             TaskMode
 	GroupIDs         []int64
-	StatusMessageIDs map[int64]int // groupID -> messageID for status messages
+	GroupID          int64 // group that requested the task first, used for fair scheduling
+	Priority         TaskPriority
+	QueueRank        int              // number of active tasks the group already had when the task was created, never recomputed
+	StatusMessageIDs map[int64]int    // groupID -> messageID for status messages
+	Requesters       map[int64]string // groupID -> username of the user who posted the link
 	Status           TaskStatus
+	Attempts         int        // number of failed attempts so far
+	LastError        string     // error of the latest failed attempt
+	NextAttemptAt    *time.Time // task is not picked up before this moment, nil means immediately
+	WorkerID         string     // worker holding the lease of an in-progress task
+	LeaseExpiresAt   *time.Time // in-progress task is reclaimed after this moment unless the lease is renewed
+	CreatedAt        *time.Time
+	StartedAt        *time.Time // start of the latest attempt
+}
+
+// ArchivedTask is a finished task kept in the task history
+type ArchivedTask struct {
+	ID       int // ID of the history entry, not of the task
+	Link     string
+	Mode     TaskMode
+	GroupIDs []int64
+	Outcome  TaskOutcome
+}
+
+// TaskOutcome describes how a finished task ended, it is stored in the task history
+type TaskOutcome struct {
+	Status   TaskStatus // TaskStatusCompleted, TaskStatusFailed or TaskStatusCancelled
+	Platform string     // supported link name, empty if the link was not recognised
+	FileSize int64
+	Duration float64 // media duration in seconds, 0 if unknown
+	Error    string
 }
\ No newline at end of file
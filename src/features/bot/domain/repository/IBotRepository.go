@@ -13,11 +13,20 @@ type IBotRepository interface {
 	SendDirectMessage(userID int64, message string) error
 	SendGroupMessage(chatID int64, message string) error
 	SendGroupMessageWithID(chatID int64, message string) (int, error)
+	SendDirectMessageWithKeyboard(userID int64, message string, keyboard entity.InlineKeyboard) error
+	SendGroupMessageWithKeyboard(chatID int64, message string, keyboard entity.InlineKeyboard) (int, error)
 
 	UpdateDirectMessage(userID int64, messageID int, newText string) error
+	// Edits and the deletion of a group message are queued and applied in their order, an edit still waiting
+	// for its turn under the rate limits is replaced by a newer one. They return once queued.
 	UpdateGroupMessage(chatID int64, messageID int, newText string) error
+	UpdateDirectMessageWithKeyboard(userID int64, messageID int, newText string, keyboard entity.InlineKeyboard) error
+	UpdateGroupMessageWithKeyboard(chatID int64, messageID int, newText string, keyboard entity.InlineKeyboard) error
+
+	// AnswerCallbackQuery has to be called for every pressed button, a non-empty text is shown to the user
+	AnswerCallbackQuery(callbackQueryID string, text string) error
 
 	DeleteGroupMessage(chatID int64, messageID int) error
 
 	GetChatInfo(chatID int64) (*entity.ChatInfo, error)
-}
+}
\ No newline at end of file
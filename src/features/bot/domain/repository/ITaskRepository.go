@@ -1,12 +1,35 @@
 package repository
 
-import "tg-downloader/src/features/bot/domain/entity"
+import (
+	"context"
+	"tg-downloader/src/features/bot/domain/entity"
+	"time"
+)
 
 type ITaskRepository interface {
-	CreateTask(link string, groupID int64, messageID int) (*entity.Task, error)
-	GetNextTask() (*entity.Task, error)
-	MarkTaskInProgress(id int) error
-	DeleteTask(id int) error
-	FindTaskByLink(link string) (*entity.Task, error)
-	AddGroupToTask(taskID int, groupID int64, messageID int) error
+	CreateTask(ctx context.Context, link string, mode entity.TaskMode, groupID int64, messageID int, requester string, priority entity.TaskPriority) (*entity.Task, error)
+	ClaimNextTask(ctx context.Context, workerID string, leaseDuration time.Duration, maxTasksPerGroup int) (*entity.Task, error)
+	RenewLease(ctx context.Context, id int, workerID string, leaseDuration time.Duration) error
+	ReleaseTask(ctx context.Context, id int, workerID string) error
+	// ReclaimStaleTasks returns the tasks put back to the queue and the ones failed after their last attempt,
+	// the latter by the ID of their history entry
+	ReclaimStaleTasks(ctx context.Context, maxRetries int) ([]*entity.Task, map[int]*entity.Task, error)
+	// ScheduleRetry and ArchiveTask return entity.ErrTaskLeaseLost when the worker does not own the task anymore
+	ScheduleRetry(ctx context.Context, id int, workerID string, lastError string, nextAttemptAt time.Time) error
+	DeleteTask(ctx context.Context, id int) error
+	// ArchiveTask moves the task to the task history and returns the ID of the history entry
+	ArchiveTask(ctx context.Context, id int, workerID string, outcome entity.TaskOutcome) (int, error)
+	GetArchivedTask(ctx context.Context, historyID int) (*entity.ArchivedTask, error)
+	PruneHistory(ctx context.Context, finishedBefore time.Time) (int, error)
+	ListPendingTasks(ctx context.Context, maxTasksPerGroup int) ([]*entity.Task, error)
+	AverageProcessingTime(ctx context.Context, sampleSize int) (time.Duration, error)
+	GetTask(ctx context.Context, id int) (*entity.Task, error)
+	FindTaskByLink(ctx context.Context, link string, mode entity.TaskMode) (*entity.Task, error)
+	// FindTaskByStatusMessage returns entity.ErrTaskNotFound when no queued or running task has the status message
+	FindTaskByStatusMessage(ctx context.Context, groupID int64, messageID int) (*entity.Task, error)
+	RemoveGroupFromTask(ctx context.Context, taskID int, groupID int64) (*entity.Task, error)
+	AddGroupToTask(ctx context.Context, taskID int, groupID int64, messageID int, requester string) error
+	// GiveUpCancelledTask finishes a cancelled task of the worker, returns whether a group requested it again
+	// and it was put back to the queue
+	GiveUpCancelledTask(ctx context.Context, id int, workerID string) (bool, error)
 }
\ No newline at end of file
@@ -14,8 +14,14 @@ import (
 	"tg-downloader/src/features/bot/domain/repository"
 	systemEntity "tg-downloader/src/features/system/domain/entity"
 	systemRepo "tg-downloader/src/features/system/domain/repository"
+	"time"
 )
 
+// cancelKeyboard is attached to the status message of a download that can still be cancelled
+var cancelKeyboard = entity.InlineKeyboard{{
+	{Text: "🚫 Отменить", Data: entity.CallbackData{Action: entity.CallbackActionCancelResource}},
+}}
+
 type BotService struct {
 	botRepo     repository.IBotRepository
 	cacheRepo   repository.IBotCacheRepository
@@ -105,6 +111,8 @@ func (s *BotService) isGroupCommand(command env.Command) bool {
 		core.DeactivateCommandKey: true,
 		core.GetBotCommandsKey:    true,
 		core.LoadResourceKey:      true,
+		core.LoadAudioResourceKey: true,
+		core.CancelResourceKey:    true,
 	}
 
 	for key, envCmd := range s.environment.CommandConfiguration.Commands {
@@ -199,23 +207,28 @@ func (s *BotService) DeleteGroup(groupID int64, userID int64, userName string) e
 		return s.sendDirectMessage(userID, "❌ Only admins can delete groups")
 	}
 
+	return s.sendDirectMessage(userID, s.removeGroup(groupID))
+}
+
+// removeGroup deletes the activated group and returns the message describing the result
+func (s *BotService) removeGroup(groupID int64) string {
 	// Convert groupID to string for cache operations
 	groupIDStr := strconv.FormatInt(groupID, 10)
 
 	// Check if group exists
-	_, err = s.cacheRepo.GetGroup(groupIDStr)
+	_, err := s.cacheRepo.GetGroup(groupIDStr)
 	if err != nil {
 		// Group doesn't exist
-		return s.sendDirectMessage(userID, fmt.Sprintf("⚠️ Group %d is not found", groupID))
+		return fmt.Sprintf("⚠️ Group %d is not found", groupID)
 	}
 
 	// Delete group from cache
 	err = s.cacheRepo.DeleteGroup(groupIDStr)
 	if err != nil {
-		return s.sendDirectMessage(userID, fmt.Sprintf("❌ Error deleting group %d", groupID))
+		return fmt.Sprintf("❌ Error deleting group %d", groupID)
 	}
 
-	return s.sendDirectMessage(userID, fmt.Sprintf("✅ Group %d deleted successfully", groupID))
+	return fmt.Sprintf("✅ Group %d deleted successfully", groupID)
 }
 
 func (s *BotService) GetAllGroups(userID int64, userName string) error {
@@ -229,21 +242,132 @@ func (s *BotService) GetAllGroups(userID int64, userName string) error {
 		return s.sendDirectMessage(userID, "❌ Only admins can view all groups")
 	}
 
+	message, keyboard, err := s.groupsPage(userName, 0)
+	if err != nil {
+		return s.sendDirectMessage(userID, "❌ Error retrieving groups")
+	}
+
+	return s.botRepo.SendDirectMessageWithKeyboard(userID, message, keyboard)
+}
+
+// ShowGroupsPage replaces the group list the admin pressed a button of with another of its pages
+func (s *BotService) ShowGroupsPage(callbackQueryID string, userID int64, userName string, messageID int, page int) error {
+	if !s.isAdminButton(callbackQueryID, userName, "❌ Only admins can view all groups") {
+		return nil
+	}
+
+	message, keyboard, err := s.groupsPage(userName, page)
+	if err != nil {
+		s.answerButton(callbackQueryID, "❌ Error retrieving groups")
+		return err
+	}
+
+	err = s.botRepo.UpdateDirectMessageWithKeyboard(userID, messageID, message, keyboard)
+	s.answerButton(callbackQueryID, "")
+	return err
+}
+
+// AskDeleteGroup replaces the group list with the question whether the group should really be deleted
+func (s *BotService) AskDeleteGroup(callbackQueryID string, userID int64, userName string, messageID int, groupID int64, page int) error {
+	if !s.isAdminButton(callbackQueryID, userName, "❌ Only admins can delete groups") {
+		return nil
+	}
+
+	groupName := strconv.FormatInt(groupID, 10)
+	if chatInfo, err := s.botRepo.GetChatInfo(groupID); err == nil && chatInfo.Title != "" {
+		groupName = fmt.Sprintf("%s (ID: %d)", strings.ToUpper(chatInfo.Title), groupID)
+	}
+
+	message := fmt.Sprintf("⚠️ Delete group %s?\n\nLinks posted there will not be downloaded anymore.", groupName)
+	keyboard := entity.InlineKeyboard{{
+		{Text: "✅ Yes, delete", Data: entity.CallbackData{Action: entity.CallbackActionConfirmDeleteGroup, Args: []int64{groupID, int64(page)}}},
+		groupsPageButton("↩️ Back", page),
+	}}
+
+	err := s.botRepo.UpdateDirectMessageWithKeyboard(userID, messageID, message, keyboard)
+	s.answerButton(callbackQueryID, "")
+	return err
+}
+
+// ConfirmDeleteGroup deletes the group and shows the group list again
+func (s *BotService) ConfirmDeleteGroup(callbackQueryID string, userID int64, userName string, messageID int, groupID int64, page int) error {
+	if !s.isAdminButton(callbackQueryID, userName, "❌ Only admins can delete groups") {
+		return nil
+	}
+
+	result := s.removeGroup(groupID)
+	s.logger.Info(fmt.Sprintf("Admin %s deleted group %d from the group list: %s", userName, groupID, result))
+
+	message, keyboard, err := s.groupsPage(userName, page)
+	if err == nil {
+		err = s.botRepo.UpdateDirectMessageWithKeyboard(userID, messageID, message, keyboard)
+	}
+	s.answerButton(callbackQueryID, result)
+	return err
+}
+
+// groupsPage formats a page of the groups of the admin, with a delete button for every group
+// and buttons to the neighbouring pages. A page past the end shows the last page.
+func (s *BotService) groupsPage(userName string, page int) (string, entity.InlineKeyboard, error) {
 	// Get all groups for this admin
 	groups, err := s.cacheRepo.GetAllGroupsByUserName(userName)
 	if err != nil {
-		return s.sendDirectMessage(userID, "❌ Error retrieving groups")
+		return "", nil, err
 	}
 
 	if len(groups) == 0 {
-		return s.sendDirectMessage(userID, "📝 No groups found")
+		return "📝 No groups found", nil, nil
 	}
 
+	pages := (len(groups) + core.GroupsPageSize - 1) / core.GroupsPageSize
+	page = max(0, min(page, pages-1))
+	first := page * core.GroupsPageSize
+	pageGroups := groups[first:min(first+core.GroupsPageSize, len(groups))]
+
 	// Fetch chat info in parallel and format message
-	results := s.fetchGroupInfoInParallel(groups)
-	message := s.formatGroupsMessage(results)
+	results := s.fetchGroupInfoInParallel(pageGroups)
+	message := s.formatGroupsMessage(results, len(groups), first)
+	if pages > 1 {
+		message += fmt.Sprintf("📄 Page %d/%d", page+1, pages)
+	}
 
-	return s.sendDirectMessage(userID, message)
+	keyboard := make(entity.InlineKeyboard, 0, len(results)+1)
+	for _, result := range results {
+		groupID, err := strconv.ParseInt(result.group.GroupID, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		groupName := result.group.GroupID
+		if result.err == nil && result.chatInfo != nil && result.chatInfo.Title != "" {
+			groupName = result.chatInfo.Title
+		}
+
+		keyboard = append(keyboard, []entity.InlineButton{{
+			Text: fmt.Sprintf("🗑 Delete %d. %s", first+result.index+1, groupName),
+			Data: entity.CallbackData{Action: entity.CallbackActionDeleteGroup, Args: []int64{groupID, int64(page)}},
+		}})
+	}
+
+	var navigation []entity.InlineButton
+	if page > 0 {
+		navigation = append(navigation, groupsPageButton("◀️ Previous", page-1))
+	}
+	if page < pages-1 {
+		navigation = append(navigation, groupsPageButton("Next ▶️", page+1))
+	}
+	if len(navigation) > 0 {
+		keyboard = append(keyboard, navigation)
+	}
+
+	return message, keyboard, nil
+}
+
+func groupsPageButton(text string, page int) entity.InlineButton {
+	return entity.InlineButton{
+		Text: text,
+		Data: entity.CallbackData{Action: entity.CallbackActionGroupsPage, Args: []int64{int64(page)}},
+	}
 }
 
 type groupResult struct {
@@ -282,28 +406,29 @@ func (s *BotService) fetchSingleGroupInfo(index int, group *entity.Group, result
 	resultChan <- groupResult{index, group, chatInfo, chatErr}
 }
 
-func (s *BotService) formatGroupsMessage(results []groupResult) string {
-	message := fmt.Sprintf("📋 ACTIVE GROUPS (%d):\n\n", len(results))
+// formatGroupsMessage formats a page of the group list, first is the index of the first group on the page
+func (s *BotService) formatGroupsMessage(results []groupResult, total int, first int) string {
+	message := fmt.Sprintf("📋 ACTIVE GROUPS (%d):\n\n", total)
 
 	for _, result := range results {
 		if result.err != nil || result.chatInfo == nil {
-			message += s.formatGroupEntryWithError(result)
+			message += s.formatGroupEntryWithError(result, first+result.index+1)
 		} else {
-			message += s.formatGroupEntryWithInfo(result)
+			message += s.formatGroupEntryWithInfo(result, first+result.index+1)
 		}
 	}
 
 	return message
 }
 
-func (s *BotService) formatGroupEntryWithError(result groupResult) string {
+func (s *BotService) formatGroupEntryWithError(result groupResult, number int) string {
 	return fmt.Sprintf("%d. Group ID: %s (Admin: %s) - ⚠️ Info unavailable\n",
-		result.index+1, result.group.GroupID, result.group.AdminUserName)
+		number, result.group.GroupID, result.group.AdminUserName)
 }
 
-func (s *BotService) formatGroupEntryWithInfo(result groupResult) string {
+func (s *BotService) formatGroupEntryWithInfo(result groupResult, number int) string {
 	return fmt.Sprintf("%d. %s\n   ID: %s\n   Type: %s\n   Admin: %s\n\n",
-		result.index+1, strings.ToUpper(result.chatInfo.Title), result.group.GroupID,
+		number, strings.ToUpper(result.chatInfo.Title), result.group.GroupID,
 		result.chatInfo.Type, result.group.AdminUserName)
 }
 
@@ -490,11 +615,9 @@ func (s *BotService) formatCommandList(commands []entity.Command, context string
 	return builder.String()
 }
 
-func (s *BotService) LoadResource(groupID int64, link string) (int, bool, error) {
+func (s *BotService) LoadResource(groupID int64, link string, mode entity.TaskMode) (int, bool, error) {
 	// Check if group is activated first
-	groupIDStr := strconv.FormatInt(groupID, 10)
-	_, err := s.cacheRepo.GetGroup(groupIDStr)
-	if err != nil {
+	if !s.isGroupActivated(groupID) {
 		// Group is not activated
 		err := s.sendGroupMessage(groupID, "❌ Group is not activated. Use /a to activate the group first.")
 		return 0, false, err
@@ -535,13 +658,90 @@ func (s *BotService) LoadResource(groupID int64, link string) (int, bool, error)
 	}
 
 	// Send confirmation that processing started, get message ID for later updates
-	messageID, err := s.botRepo.SendGroupMessageWithID(groupID, "⏳ Скачивание видео...")
+	messageID, err := s.botRepo.SendGroupMessageWithKeyboard(groupID, loadingStatus(mode), cancelKeyboard)
 	if err != nil {
 		return 0, false, err
 	}
 	return messageID, true, nil
 }
 
+// RetryResource turns the failure message of a download into its status message again.
+// Returns false when the group can't request links anymore.
+func (s *BotService) RetryResource(groupID int64, messageID int, mode entity.TaskMode) (bool, error) {
+	if !s.isGroupActivated(groupID) {
+		err := s.sendGroupMessage(groupID, "❌ Group is not activated. Use /a to activate the group first.")
+		return false, err
+	}
+
+	if err := s.updateStatusMessage(groupID, messageID, loadingStatus(mode)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *BotService) isGroupActivated(groupID int64) bool {
+	groupIDStr := strconv.FormatInt(groupID, 10)
+	_, err := s.cacheRepo.GetGroup(groupIDStr)
+	return err == nil
+}
+
+// loadingStatus is the first text of the status message of a download
+func loadingStatus(mode entity.TaskMode) string {
+	if mode == entity.TaskModeAudio {
+		return "⏳ Скачивание аудио..."
+	}
+	return "⏳ Скачивание видео..."
+}
+
+// GetResourcePriority returns the queue priority of links posted by the user
+func (s *BotService) GetResourcePriority(userName string) entity.TaskPriority {
+	if !s.environment.WorkerConfiguration.PrioritizeAdminLinks {
+		return entity.TaskPriorityNormal
+	}
+
+	isAdmin, err := s.botRepo.IsAdmin(userName)
+	if err != nil || !isAdmin {
+		return entity.TaskPriorityNormal
+	}
+
+	return entity.TaskPriorityAdmin
+}
+
+func (s *BotService) HandleVideoQueuePositionChanged(groupID int64, messageID int, position int, eta time.Duration) error {
+	message := fmt.Sprintf("⏳ #%d в очереди", position)
+	if eta > 0 {
+		message += fmt.Sprintf(", ожидание ~%s", formatWaitTime(eta))
+	}
+	return s.updateStatusMessage(groupID, messageID, message)
+}
+
+func (s *BotService) HandleVideoDownloadStarted(groupID int64, messageID int) error {
+	return s.updateStatusMessage(groupID, messageID, "⏳ Скачивание...")
+}
+
+func (s *BotService) HandleVideoDownloadProgress(groupID int64, messageID int, percent float64, downloadedBytes int64, totalBytes int64, speed float64) error {
+	message := fmt.Sprintf("⏳ Скачивание... %s", formatMegabytes(downloadedBytes))
+	if totalBytes > 0 {
+		message = fmt.Sprintf("⏳ Скачивание... %.0f%% (%s / %s)", percent, formatMegabytes(downloadedBytes), formatMegabytes(totalBytes))
+	}
+	if speed > 0 {
+		message += fmt.Sprintf(", %s/с", formatMegabytes(int64(speed)))
+	}
+	return s.updateStatusMessage(groupID, messageID, message)
+}
+
+func (s *BotService) HandleVideoCompressionStarted(groupID int64, messageID int) error {
+	return s.updateStatusMessage(groupID, messageID, "🗜 Видео слишком большое, сжимаем...")
+}
+
+func (s *BotService) HandleVideoProcessResumed(groupID int64, messageID int) error {
+	return s.updateStatusMessage(groupID, messageID, "🔄 Скачивание возобновлено после перезапуска...")
+}
+
+func (s *BotService) HandleVideoCancelled(groupID int64, messageID int) error {
+	return s.botRepo.UpdateGroupMessage(groupID, messageID, "🚫 Скачивание отменено")
+}
+
 func (s *BotService) HandleVideoUploadStarted(groupID int64, messageID int) error {
 	return s.botRepo.UpdateGroupMessage(groupID, messageID, "📤 Отправка в Telegram...")
 }
@@ -551,12 +751,71 @@ func (s *BotService) HandleVideoProcessSuccess(groupID int64, messageID int) err
 	return s.botRepo.DeleteGroupMessage(groupID, messageID)
 }
 
-func (s *BotService) HandleVideoProcessFailure(groupID int64, messageID int, errorMessage string) error {
+// HandleVideoProcessFailure shows the error on the status message, with a retry button when the failed
+// download is kept in the task history
+func (s *BotService) HandleVideoProcessFailure(groupID int64, messageID int, errorMessage string, historyID int) error {
 	// Update the status message with error details
 	message := fmt.Sprintf("❌ Ошибка: %s", errorMessage)
-	return s.botRepo.UpdateGroupMessage(groupID, messageID, message)
+	if historyID == 0 {
+		return s.botRepo.UpdateGroupMessage(groupID, messageID, message)
+	}
+
+	retryKeyboard := entity.InlineKeyboard{{
+		{Text: "🔄 Повторить", Data: entity.CallbackData{Action: entity.CallbackActionRetryResource, Args: []int64{int64(historyID)}}},
+	}}
+	return s.botRepo.UpdateGroupMessageWithKeyboard(groupID, messageID, message, retryKeyboard)
+}
+
+// updateStatusMessage shows the state of a download which can still be cancelled
+func (s *BotService) updateStatusMessage(groupID int64, messageID int, message string) error {
+	return s.botRepo.UpdateGroupMessageWithKeyboard(groupID, messageID, message, cancelKeyboard)
+}
+
+// AnswerButton answers a pressed button, a non-empty text is shown to the user who pressed it
+func (s *BotService) AnswerButton(callbackQueryID string, text string) error {
+	return s.botRepo.AnswerCallbackQuery(callbackQueryID, text)
+}
+
+// answerButton answers a pressed button, a failed answer only leaves the button loading for a while
+func (s *BotService) answerButton(callbackQueryID string, text string) {
+	if err := s.AnswerButton(callbackQueryID, text); err != nil {
+		s.logger.Warn(fmt.Sprintf("Failed to answer callback query: %v", err))
+	}
+}
+
+// isAdminButton tells whether the user who pressed an admin button is an admin, others get the denial as the answer
+func (s *BotService) isAdminButton(callbackQueryID string, userName string, denial string) bool {
+	isAdmin, err := s.botRepo.IsAdmin(userName)
+	if err != nil {
+		s.answerButton(callbackQueryID, "❌ Error checking admin status")
+		return false
+	}
+
+	if !isAdmin {
+		s.answerButton(callbackQueryID, denial)
+		return false
+	}
+
+	return true
 }
 
 func (s *BotService) sendDirectMessage(userID int64, message string) error {
 	return s.botRepo.SendDirectMessage(userID, message)
 }
+
+// formatWaitTime formats an estimated waiting time rounded to minutes
+func formatWaitTime(wait time.Duration) string {
+	minutes := int(wait.Round(time.Minute).Minutes())
+	if minutes < 1 {
+		return "1 мин"
+	}
+	if minutes < 60 {
+		return fmt.Sprintf("%d мин", minutes)
+	}
+	return fmt.Sprintf("%d ч %d мин", minutes/60, minutes%60)
+}
+
+// formatMegabytes formats a byte count in megabytes with one decimal
+func formatMegabytes(bytes int64) string {
+	return fmt.Sprintf("%.1f МБ", float64(bytes)/(1024*1024))
+}
\ No newline at end of file
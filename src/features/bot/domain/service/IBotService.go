@@ -1,6 +1,9 @@
 package service
 
-import "tg-downloader/src/features/bot/domain/entity"
+import (
+	"tg-downloader/src/features/bot/domain/entity"
+	"time"
+)
 
 type IBotService interface {
 	UpdateCommandsForUser(userID int64, userName string) error
@@ -10,13 +13,25 @@ type IBotService interface {
 	DeactivateGroup(groupID int64, userID int64, userName string) error
 	DeleteGroup(groupID int64, userID int64, userName string) error
 	GetAllGroups(userID int64, userName string) error
+	ShowGroupsPage(callbackQueryID string, userID int64, userName string, messageID int, page int) error
+	AskDeleteGroup(callbackQueryID string, userID int64, userName string, messageID int, groupID int64, page int) error
+	ConfirmDeleteGroup(callbackQueryID string, userID int64, userName string, messageID int, groupID int64, page int) error
 	GetServerLoad(userID int64, userName string) error
 	GetDirectCommands(userID int64, userName string) error
 	GetGroupCommands(groupID int64, userID int64, userName string) error
 	HandleDirectError(userID int64, userName string, message string) error
 	HandleGroupError(groupID int64, message string) error
-	LoadResource(groupID int64, link string) (messageID int, canProcess bool, err error)
+	LoadResource(groupID int64, link string, mode entity.TaskMode) (messageID int, canProcess bool, err error)
+	RetryResource(groupID int64, messageID int, mode entity.TaskMode) (bool, error)
+	GetResourcePriority(userName string) entity.TaskPriority
+	AnswerButton(callbackQueryID string, text string) error
+	HandleVideoQueuePositionChanged(groupID int64, messageID int, position int, eta time.Duration) error
+	HandleVideoDownloadStarted(groupID int64, messageID int) error
+	HandleVideoDownloadProgress(groupID int64, messageID int, percent float64, downloadedBytes int64, totalBytes int64, speed float64) error
+	HandleVideoCompressionStarted(groupID int64, messageID int) error
+	HandleVideoProcessResumed(groupID int64, messageID int) error
+	HandleVideoCancelled(groupID int64, messageID int) error
 	HandleVideoUploadStarted(groupID int64, messageID int) error
 	HandleVideoProcessSuccess(groupID int64, messageID int) error
-	HandleVideoProcessFailure(groupID int64, messageID int, errorMessage string) error
+	HandleVideoProcessFailure(groupID int64, messageID int, errorMessage string, historyID int) error
 }
@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"errors"
 	"fmt"
 	"tg-downloader/src/core/logger"
 	"tg-downloader/src/features/bot/domain/entity"
@@ -59,7 +60,7 @@ func (c *BotController) updateCommands(event entity.BotEvent) {
 	switch e := event.(type) {
 	case entity.DirectGetBotCommands, entity.GetServerLoad, entity.GetAllGroups, entity.DeleteGroup, entity.ErrorDirect, entity.GetResource:
 		c.updateDirectCommands(e)
-	case entity.GroupGetBotCommands, entity.ActivateGroup, entity.DeactivateGroup, entity.ErrorGroup:
+	case entity.GroupGetBotCommands, entity.ActivateGroup, entity.DeactivateGroup, entity.CancelResource, entity.ErrorGroup:
 		c.updateGroupCommands(e)
 	case entity.IgnoreCommand:
 		if e.GroupID == 0 {
@@ -93,6 +94,8 @@ func (c *BotController) updateGroupCommands(event entity.BotEvent) {
 		c.service.UpdateCommandsForGroupUser(e.GroupID, e.UserID, e.UserName)
 	case entity.DeactivateGroup:
 		c.service.UpdateCommandsForGroupUser(e.GroupID, e.UserID, e.UserName)
+	case entity.CancelResource:
+		c.service.UpdateCommandsForGroupUser(e.GroupID, e.UserID, e.UserName)
 	case entity.IgnoreCommand:
 		c.service.UpdateCommandsForGroupUser(e.GroupID, e.UserID, e.UserName)
 	}
@@ -113,15 +116,31 @@ func (c *BotController) handleBusinessLogic(event entity.BotEvent) {
 	case entity.StartBot:
 		c.service.GetDirectCommands(e.UserID, e.UserName)
 	case entity.GetResource:
-		messageID, canProcess, err := c.service.LoadResource(e.GroupID, e.Link)
+		messageID, canProcess, err := c.service.LoadResource(e.GroupID, e.Link, e.Mode)
 		if err != nil {
 			// Error already handled by service (message sent to user)
 			return
 		}
 		if canProcess {
 			// Start video processing with status message ID for updates
-			c.videoService.ProcessVideo(e.Link, e.GroupID, messageID)
+			priority := c.service.GetResourcePriority(e.UserName)
+			c.videoService.ProcessVideo(e.Link, e.Mode, e.GroupID, messageID, e.UserName, priority)
 		}
+	case entity.CancelResource:
+		c.cancelResource(e)
+	case entity.CancelResourcePressed:
+		c.cancelResourcePressed(e)
+	case entity.RetryResourcePressed:
+		c.retryResourcePressed(e)
+	case entity.GroupsPagePressed:
+		c.service.ShowGroupsPage(e.CallbackQueryID, e.UserID, e.UserName, e.MessageID, e.Page)
+	case entity.DeleteGroupPressed:
+		c.service.AskDeleteGroup(e.CallbackQueryID, e.UserID, e.UserName, e.MessageID, e.GroupID, e.Page)
+	case entity.DeleteGroupConfirmed:
+		c.service.ConfirmDeleteGroup(e.CallbackQueryID, e.UserID, e.UserName, e.MessageID, e.GroupID, e.Page)
+	case entity.InvalidButtonPressed:
+		c.logger.Warn(fmt.Sprintf("User %s pressed a button with invalid data in chat %d", e.UserName, e.ChatID))
+		c.answerButton(e.ButtonPress, "⚠️ This button is no longer valid")
 	case entity.DirectGetBotCommands:
 		c.service.GetDirectCommands(e.UserID, e.UserName)
 	case entity.GroupGetBotCommands:
@@ -138,16 +157,115 @@ func (c *BotController) handleBusinessLogic(event entity.BotEvent) {
 	}
 }
 
+func (c *BotController) cancelResource(event entity.CancelResource) {
+	if problem := c.cancelVideo(event.GroupID, event.MessageID, event.Link, event.UserName); problem != "" {
+		c.service.HandleGroupError(event.GroupID, problem)
+	}
+}
+
+// cancelResourcePressed cancels the download of the status message the cancel button is attached to
+func (c *BotController) cancelResourcePressed(event entity.CancelResourcePressed) {
+	problem := c.cancelVideo(event.ChatID, event.MessageID, "", event.UserName)
+	c.answerButton(event.ButtonPress, problem)
+}
+
+// cancelVideo cancels the download of the group and marks its status message as cancelled.
+// Returns the message telling the user why nothing was cancelled, empty on success.
+func (c *BotController) cancelVideo(groupID int64, messageID int, link string, userName string) string {
+	statusMessageID, err := c.videoService.CancelVideo(groupID, messageID, link)
+	if errors.Is(err, videoService.ErrNothingToCancel) {
+		return "⚠️ No queued download found to cancel"
+	}
+	if err != nil {
+		c.logger.Error(fmt.Sprintf("CancelVideo failed for group %d: %v", groupID, err))
+		return "❌ Failed to cancel the download"
+	}
+
+	c.logger.Info(fmt.Sprintf("User %s cancelled download in group %d", userName, groupID))
+	if statusMessageID > 0 {
+		if err := c.service.HandleVideoCancelled(groupID, statusMessageID); err != nil {
+			c.logger.Error(fmt.Sprintf("HandleVideoCancelled failed: %v", err))
+		}
+	}
+	return ""
+}
+
+// retryResourcePressed requests the link of a failed download again, the failure message
+// the retry button is attached to becomes the status message of the new download
+func (c *BotController) retryResourcePressed(event entity.RetryResourcePressed) {
+	archivedTask, err := c.videoService.FindFailedTask(event.ChatID, event.HistoryID)
+	if err != nil {
+		c.answerButton(event.ButtonPress, "⚠️ This download can't be retried anymore")
+		return
+	}
+
+	canProcess, err := c.service.RetryResource(event.ChatID, event.MessageID, archivedTask.Mode)
+	c.answerButton(event.ButtonPress, "")
+	if err != nil || !canProcess {
+		return
+	}
+
+	c.logger.Info(fmt.Sprintf("User %s retried %s in group %d", event.UserName, archivedTask.Link, event.ChatID))
+	priority := c.service.GetResourcePriority(event.UserName)
+	c.videoService.ProcessVideo(archivedTask.Link, archivedTask.Mode, event.ChatID, event.MessageID, event.UserName, priority)
+}
+
+func (c *BotController) answerButton(press entity.ButtonPress, text string) {
+	if err := c.service.AnswerButton(press.CallbackQueryID, text); err != nil {
+		c.logger.Warn(fmt.Sprintf("Failed to answer callback query of user %s: %v", press.UserName, err))
+	}
+}
+
 func (c *BotController) processVideoEvents() {
 	videoEvents := c.videoService.GetVideoEvents()
 
+	// Handled in the order they were emitted: the handlers only queue the edits of status messages,
+	// and a stale progress update handled late would overwrite the final state of the message
 	for event := range videoEvents {
-		go c.handleVideoEvent(event)
+		c.handleVideoEvent(event)
 	}
 }
 
 func (c *BotController) handleVideoEvent(event videoEntity.VideoEvent) {
 	switch e := event.(type) {
+	case videoEntity.VideoQueuePositionChanged:
+		c.logger.Debug(fmt.Sprintf("Received queue position event for group %d, messageID=%d, position=%d", e.GroupID, e.MessageID, e.Position))
+		err := c.service.HandleVideoQueuePositionChanged(e.GroupID, e.MessageID, e.Position, e.ETA)
+		if err != nil {
+			c.logger.Error(fmt.Sprintf("HandleVideoQueuePositionChanged failed: %v", err))
+		} else {
+			c.logger.Debug("HandleVideoQueuePositionChanged completed successfully")
+		}
+	case videoEntity.VideoDownloadStarted:
+		c.logger.Debug(fmt.Sprintf("Received download started event for group %d, messageID=%d", e.GroupID, e.MessageID))
+		err := c.service.HandleVideoDownloadStarted(e.GroupID, e.MessageID)
+		if err != nil {
+			c.logger.Error(fmt.Sprintf("HandleVideoDownloadStarted failed: %v", err))
+		} else {
+			c.logger.Debug("HandleVideoDownloadStarted completed successfully")
+		}
+	case videoEntity.VideoDownloadProgress:
+		progress := e.Progress
+		err := c.service.HandleVideoDownloadProgress(e.GroupID, e.MessageID, progress.Percent, progress.DownloadedBytes, progress.TotalBytes, progress.Speed)
+		if err != nil {
+			c.logger.Error(fmt.Sprintf("HandleVideoDownloadProgress failed: %v", err))
+		}
+	case videoEntity.VideoCompressionStarted:
+		c.logger.Debug(fmt.Sprintf("Received compression started event for group %d, messageID=%d", e.GroupID, e.MessageID))
+		err := c.service.HandleVideoCompressionStarted(e.GroupID, e.MessageID)
+		if err != nil {
+			c.logger.Error(fmt.Sprintf("HandleVideoCompressionStarted failed: %v", err))
+		} else {
+			c.logger.Debug("HandleVideoCompressionStarted completed successfully")
+		}
+	case videoEntity.VideoProcessResumed:
+		c.logger.Debug(fmt.Sprintf("Received process resumed event for group %d, messageID=%d", e.GroupID, e.MessageID))
+		err := c.service.HandleVideoProcessResumed(e.GroupID, e.MessageID)
+		if err != nil {
+			c.logger.Error(fmt.Sprintf("HandleVideoProcessResumed failed: %v", err))
+		} else {
+			c.logger.Debug("HandleVideoProcessResumed completed successfully")
+		}
 	case videoEntity.VideoUploadStarted:
 		c.logger.Debug(fmt.Sprintf("Received upload started event for group %d, messageID=%d", e.GroupID, e.MessageID))
 		err := c.service.HandleVideoUploadStarted(e.GroupID, e.MessageID)
@@ -166,7 +284,7 @@ func (c *BotController) handleVideoEvent(event videoEntity.VideoEvent) {
 		}
 	case videoEntity.VideoProcessFailure:
 		c.logger.Debug(fmt.Sprintf("Received video failure event for group %d, messageID=%d, error=%s", e.GroupID, e.MessageID, e.ErrorMessage))
-		err := c.service.HandleVideoProcessFailure(e.GroupID, e.MessageID, e.ErrorMessage)
+		err := c.service.HandleVideoProcessFailure(e.GroupID, e.MessageID, e.ErrorMessage, e.HistoryID)
 		if err != nil {
 			c.logger.Error(fmt.Sprintf("HandleVideoProcessFailure failed: %v", err))
 		} else {
@@ -175,4 +293,4 @@ func (c *BotController) handleVideoEvent(event videoEntity.VideoEvent) {
 	default:
 		c.logger.Warn(fmt.Sprintf("Unknown video event type: %T", e))
 	}
-}
+}
\ No newline at end of file
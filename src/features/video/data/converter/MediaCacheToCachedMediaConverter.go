@@ -0,0 +1,55 @@
+package converter
+
+import (
+	"tg-downloader/ent"
+	"tg-downloader/src/core"
+	botEntity "tg-downloader/src/features/bot/domain/entity"
+	"tg-downloader/src/features/video/domain/entity"
+)
+
+type MediaCacheToCachedMediaConverter struct{}
+
+func NewMediaCacheToCachedMediaConverter() *MediaCacheToCachedMediaConverter {
+	return &MediaCacheToCachedMediaConverter{}
+}
+
+func (c *MediaCacheToCachedMediaConverter) Convert() core.Codec[ent.MediaCache, entity.CachedMedia] {
+	return &mediaCacheToCachedMediaCodec{}
+}
+
+func (c *MediaCacheToCachedMediaConverter) Parse() core.Codec[entity.CachedMedia, ent.MediaCache] {
+	return &cachedMediaToMediaCacheCodec{}
+}
+
+type mediaCacheToCachedMediaCodec struct{}
+
+func (c *mediaCacheToCachedMediaCodec) Convert(source ent.MediaCache) entity.CachedMedia {
+	return entity.CachedMedia{
+		Link:         source.Link,
+		Mode:         botEntity.TaskMode(source.Mode),
+		FileID:       source.FileID,
+		FileUniqueID: source.FileUniqueID,
+		FileSize:     source.FileSize,
+		Duration:     source.Duration,
+		Title:        source.Title,
+		Uploader:     source.Uploader,
+		CreatedAt:    source.CreatedAt,
+	}
+}
+
+type cachedMediaToMediaCacheCodec struct{}
+
+func (c *cachedMediaToMediaCacheCodec) Convert(source entity.CachedMedia) ent.MediaCache {
+	return ent.MediaCache{
+		ID:           0, // Will be set by database on insert
+		Link:         source.Link,
+		Mode:         string(source.Mode),
+		FileID:       source.FileID,
+		FileUniqueID: source.FileUniqueID,
+		FileSize:     source.FileSize,
+		Duration:     source.Duration,
+		Title:        source.Title,
+		Uploader:     source.Uploader,
+		CreatedAt:    source.CreatedAt,
+	}
+}
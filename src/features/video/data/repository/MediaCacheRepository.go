@@ -0,0 +1,131 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"tg-downloader/ent"
+	"tg-downloader/ent/mediacache"
+	"tg-downloader/src/core"
+	botEntity "tg-downloader/src/features/bot/domain/entity"
+	"tg-downloader/src/features/video/data/converter"
+	"tg-downloader/src/features/video/domain/entity"
+	"tg-downloader/src/features/video/domain/repository"
+)
+
+type MediaCacheRepository struct {
+	database  *ent.Client
+	converter *converter.MediaCacheToCachedMediaConverter
+}
+
+func NewMediaCacheRepository(database *ent.Client) repository.IMediaCacheRepository {
+	return &MediaCacheRepository{
+		database:  database,
+		converter: converter.NewMediaCacheToCachedMediaConverter(),
+	}
+}
+
+func (r *MediaCacheRepository) FindMedia(ctx context.Context, link string, mode botEntity.TaskMode) (*entity.CachedMedia, error) {
+	dbMedia, err := r.database.MediaCache.Query().
+		Where(mediacache.Link(canonicalLink(link)), mediacache.Mode(string(mode))).
+		Only(ctx)
+	if ent.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	codec := r.converter.Convert()
+	media := codec.Convert(*dbMedia)
+
+	return &media, nil
+}
+
+func (r *MediaCacheRepository) SaveMedia(ctx context.Context, link string, media entity.CachedMedia) error {
+	media.Link = canonicalLink(link)
+	dbMedia := r.converter.Parse().Convert(media)
+
+	tx, err := r.database.Tx(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.MediaCache.Delete().
+		Where(mediacache.Link(dbMedia.Link), mediacache.Mode(dbMedia.Mode)).
+		Exec(ctx)
+	if err != nil {
+		return rollback(tx, err)
+	}
+
+	err = tx.MediaCache.Create().
+		SetLink(dbMedia.Link).
+		SetMode(dbMedia.Mode).
+		SetFileID(dbMedia.FileID).
+		SetFileUniqueID(dbMedia.FileUniqueID).
+		SetFileSize(dbMedia.FileSize).
+		SetDuration(dbMedia.Duration).
+		SetTitle(dbMedia.Title).
+		SetUploader(dbMedia.Uploader).
+		Exec(ctx)
+	if err != nil {
+		return rollback(tx, err)
+	}
+
+	return tx.Commit()
+}
+
+func (r *MediaCacheRepository) DeleteMedia(ctx context.Context, link string, mode botEntity.TaskMode) error {
+	_, err := r.database.MediaCache.Delete().
+		Where(mediacache.Link(canonicalLink(link)), mediacache.Mode(string(mode))).
+		Exec(ctx)
+	return err
+}
+
+// canonicalLink reduces the ways a link to the same media can be written to one: the scheme, "www." and
+// "m." hosts, youtu.be and Shorts links, tracking parameters and fragments don't make another media.
+func canonicalLink(link string) string {
+	parsed, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || parsed.Host == "" {
+		return strings.TrimSpace(link)
+	}
+
+	host := strings.ToLower(parsed.Host)
+	host = strings.TrimPrefix(host, "www.")
+	host = strings.TrimPrefix(host, "m.")
+	path := strings.TrimSuffix(parsed.EscapedPath(), "/")
+	query := parsed.Query()
+
+	switch {
+	case host == "youtu.be" && len(path) > 1:
+		query.Set("v", strings.TrimPrefix(path, "/"))
+		host, path = "youtube.com", "/watch"
+	case host == "youtube.com" && strings.HasPrefix(path, "/shorts/"):
+		query.Set("v", strings.TrimPrefix(path, "/shorts/"))
+		path = "/watch"
+	}
+
+	for key := range query {
+		if strings.HasPrefix(key, "utm_") || slices.Contains(core.LinkTrackingParameters, key) {
+			query.Del(key)
+		}
+	}
+
+	canonical := "https://" + host + path
+	if len(query) > 0 {
+		// Encode sorts the parameters by key
+		canonical += "?" + query.Encode()
+	}
+
+	return canonical
+}
+
+// rollback aborts the transaction and returns the error that caused it
+func rollback(tx *ent.Tx, err error) error {
+	if rollbackErr := tx.Rollback(); rollbackErr != nil {
+		return fmt.Errorf("%w: rollback failed: %v", err, rollbackErr)
+	}
+	return err
+}
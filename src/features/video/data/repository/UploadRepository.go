@@ -1,25 +1,500 @@
 package repository
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"tg-downloader/env"
+	"tg-downloader/src/core"
+	"tg-downloader/src/core/ratelimiter"
+	"tg-downloader/src/features/video/domain/entity"
 	"tg-downloader/src/features/video/domain/repository"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
 type UploadRepository struct {
-	botAPI *tgbotapi.BotAPI
+	environment env.TGDownloader
+	botAPI      *tgbotapi.BotAPI
+	limiter     *ratelimiter.RateLimiter
 }
 
-func NewUploadRepository(botAPI *tgbotapi.BotAPI) repository.IUploadRepository {
+func NewUploadRepository(environment env.TGDownloader, botAPI *tgbotapi.BotAPI, limiter *ratelimiter.RateLimiter) repository.IUploadRepository {
 	return &UploadRepository{
-		botAPI: botAPI,
+		environment: environment,
+		botAPI:      botAPI,
+		limiter:     limiter,
 	}
 }
 
-func (r *UploadRepository) UploadVideo(filePath string, groupID int64) error {
-	video := tgbotapi.NewVideo(groupID, tgbotapi.FilePath(filePath))
-	video.SupportsStreaming = true
+func (r *UploadRepository) UploadVideo(ctx context.Context, video *entity.VideoProcessResult, caption string, groupID int64) (*entity.UploadedMedia, error) {
+	message, err := r.sendVideo(ctx, entity.MediaItem{
+		Type:          entity.MediaTypeVideo,
+		FilePath:      video.FilePath,
+		Duration:      video.Duration,
+		Caption:       caption,
+		Width:         video.Width,
+		Height:        video.Height,
+		ThumbnailPath: video.ThumbnailPath,
+	}, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	return uploadedVideo(message), nil
+}
 
-	_, err := r.botAPI.Send(video)
+// SendVideo sends the video by its file_id, Telegram keeps the attributes and the thumbnail of the first upload
+func (r *UploadRepository) SendVideo(ctx context.Context, fileID string, caption string, groupID int64) error {
+	_, err := r.sendVideo(ctx, entity.MediaItem{
+		Type:    entity.MediaTypeVideo,
+		FileID:  fileID,
+		Caption: caption,
+	}, groupID)
 	return err
 }
+
+func (r *UploadRepository) SendAudio(ctx context.Context, fileID string, caption string, groupID int64) error {
+	_, err := r.sendAudio(ctx, entity.MediaItem{
+		Type:    entity.MediaTypeAudio,
+		FileID:  fileID,
+		Caption: caption,
+	}, groupID)
+	return err
+}
+
+// UploadMedia sends the items in their order as media groups of up to ten files. Telegram groups photos
+// with videos, documents with documents and audios with audios only, so a group ends where the kind
+// changes. Animations can't be grouped at all. Items with a FileID are sent by it instead of the file.
+func (r *UploadRepository) UploadMedia(ctx context.Context, items []entity.MediaItem, groupID int64) ([]entity.UploadedMedia, error) {
+	uploaded := make([]entity.UploadedMedia, 0, len(items))
+
+	for start := 0; start < len(items); {
+		end := start + 1
+		if kind := albumKind(items[start]); kind != "" {
+			for end < len(items) && end-start < core.MediaGroupMaxItems && albumKind(items[end]) == kind {
+				end++
+			}
+		}
+
+		var chunk []entity.UploadedMedia
+		var err error
+		if end-start == 1 {
+			chunk, err = r.sendItems(ctx, items[start:end], groupID)
+		} else {
+			chunk, err = r.sendMediaGroup(ctx, items[start:end], groupID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload items %d-%d of %d: %w", start+1, end, len(items), err)
+		}
+
+		uploaded = append(uploaded, chunk...)
+		start = end
+	}
+
+	return uploaded, nil
+}
+
+// sendMediaGroup sends the items as an album, or one by one when the album is rejected
+func (r *UploadRepository) sendMediaGroup(ctx context.Context, items []entity.MediaItem, groupID int64) ([]entity.UploadedMedia, error) {
+	media := make([]albumEntry, 0, len(items))
+	var files []tgbotapi.RequestFile
+	for i, item := range items {
+		entry, entryFiles := r.albumEntry(item, i)
+		media = append(media, entry)
+		files = append(files, entryFiles...)
+	}
+
+	params := tgbotapi.Params{}
+	params.AddNonZero64("chat_id", groupID)
+	if err := params.AddInterface("media", media); err != nil {
+		return nil, fmt.Errorf("failed to build album: %w", err)
+	}
+
+	var messages []tgbotapi.Message
+	// Every file of an album is a message of its own for the rate limits
+	err := r.retry(ctx, groupID, len(items), func(bot *tgbotapi.BotAPI) error {
+		response, err := bot.UploadFiles("sendMediaGroup", params, files)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(response.Result, &messages)
+	})
+	if err == nil {
+		return uploadedMedia(messages), nil
+	}
+
+	// Albums are atomic, so nothing was sent yet and the items can be sent separately.
+	// Only an album Telegram refused to accept is sent so, other failures would repeat for the items.
+	if ctx.Err() != nil || errors.Is(err, entity.ErrChatUnavailable) || errorCode(err) != http.StatusBadRequest {
+		return nil, err
+	}
+	return r.sendItems(ctx, items, groupID)
+}
+
+// sendItems sends every item as a message of its own
+func (r *UploadRepository) sendItems(ctx context.Context, items []entity.MediaItem, groupID int64) ([]entity.UploadedMedia, error) {
+	messages := make([]tgbotapi.Message, 0, len(items))
+	for i, item := range items {
+		var message tgbotapi.Message
+		var err error
+		switch item.Type {
+		case entity.MediaTypeVideo:
+			message, err = r.sendVideo(ctx, item, groupID)
+		case entity.MediaTypeAudio:
+			message, err = r.sendAudio(ctx, item, groupID)
+		default:
+			message, err = r.send(ctx, groupID, r.itemMessage(item, groupID))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload item %d/%d: %w", i+1, len(items), err)
+		}
+		messages = append(messages, message)
+	}
+
+	return uploadedMedia(messages), nil
+}
+
+// albumKind tells which items may share a media group, items of different kinds can't.
+// Returns an empty string for items which are never grouped.
+func albumKind(item entity.MediaItem) string {
+	switch item.Type {
+	case entity.MediaTypePhoto, entity.MediaTypeVideo:
+		return "visual"
+	case entity.MediaTypeDocument, entity.MediaTypeAudio:
+		return string(item.Type)
+	default:
+		return ""
+	}
+}
+
+// albumEntry is an entry of the media of sendMediaGroup. tgbotapi names the thumbnail by its old name
+// and uploads it under the name of the media itself, so the entries are built here.
+type albumEntry struct {
+	Type              string `json:"type"`
+	Media             string `json:"media"`
+	Thumbnail         string `json:"thumbnail,omitempty"`
+	Caption           string `json:"caption,omitempty"`
+	ParseMode         string `json:"parse_mode,omitempty"`
+	Width             int    `json:"width,omitempty"`
+	Height            int    `json:"height,omitempty"`
+	Duration          int    `json:"duration,omitempty"`
+	SupportsStreaming bool   `json:"supports_streaming,omitempty"`
+	Title             string `json:"title,omitempty"`
+	Performer         string `json:"performer,omitempty"`
+}
+
+// albumEntry builds the album entry of the item at index of the album together with the files to upload
+// for it, the type decides how Telegram shows it. Files to upload are attached by names unique in the album.
+func (r *UploadRepository) albumEntry(item entity.MediaItem, index int) (albumEntry, []tgbotapi.RequestFile) {
+	entry := albumEntry{Caption: item.Caption}
+	if item.Caption != "" {
+		entry.ParseMode = r.parseMode()
+	}
+
+	var files []tgbotapi.RequestFile
+	attach := func(name string, data tgbotapi.RequestFileData) string {
+		if !data.NeedsUpload() {
+			return data.SendData()
+		}
+		files = append(files, tgbotapi.RequestFile{Name: name, Data: data})
+		return "attach://" + name
+	}
+
+	entry.Media = attach(fmt.Sprintf("file-%d", index), r.itemFile(item))
+	// Thumbnails can't be reused by file_id, they are uploaded with the item only
+	withThumbnail := item.ThumbnailPath != "" && item.FileID == ""
+
+	switch item.Type {
+	case entity.MediaTypePhoto:
+		entry.Type = "photo"
+	case entity.MediaTypeDocument:
+		entry.Type = "document"
+	case entity.MediaTypeAudio:
+		entry.Type = "audio"
+		entry.Title = item.Title
+		entry.Performer = item.Performer
+		entry.Duration = int(item.Duration)
+		if withThumbnail {
+			entry.Thumbnail = attach(fmt.Sprintf("file-%d-thumbnail", index), tgbotapi.FilePath(item.ThumbnailPath))
+		}
+	default:
+		entry.Type = "video"
+		entry.SupportsStreaming = true
+		entry.Width = item.Width
+		entry.Height = item.Height
+		entry.Duration = int(item.Duration + 0.5)
+		if withThumbnail {
+			entry.Thumbnail = attach(fmt.Sprintf("file-%d-thumbnail", index), tgbotapi.FilePath(item.ThumbnailPath))
+		}
+	}
+
+	return entry, files
+}
+
+// itemMessage builds the message sending an item other than a video or an audio on its own,
+// those are sent by sendVideo and sendAudio
+func (r *UploadRepository) itemMessage(item entity.MediaItem, groupID int64) tgbotapi.Chattable {
+	switch item.Type {
+	case entity.MediaTypePhoto:
+		photo := tgbotapi.NewPhoto(groupID, r.itemFile(item))
+		photo.Caption = item.Caption
+		photo.ParseMode = r.parseMode()
+		return photo
+	case entity.MediaTypeAnimation:
+		animation := tgbotapi.NewAnimation(groupID, r.itemFile(item))
+		animation.Caption = item.Caption
+		animation.ParseMode = r.parseMode()
+		return animation
+	default:
+		document := tgbotapi.NewDocument(groupID, r.itemFile(item))
+		document.Caption = item.Caption
+		document.ParseMode = r.parseMode()
+		return document
+	}
+}
+
+// sendVideo sends a video with its dimensions, duration and thumbnail. tgbotapi does not send the
+// dimensions of a video and names the thumbnail by its old name, so the request is built here.
+func (r *UploadRepository) sendVideo(ctx context.Context, video entity.MediaItem, groupID int64) (tgbotapi.Message, error) {
+	params := tgbotapi.Params{}
+	params.AddNonZero64("chat_id", groupID)
+	params.AddNonEmpty("caption", video.Caption)
+	if video.Caption != "" {
+		params.AddNonEmpty("parse_mode", r.parseMode())
+	}
+	params.AddBool("supports_streaming", true)
+	params.AddNonZero("duration", int(video.Duration+0.5))
+	params.AddNonZero("width", video.Width)
+	params.AddNonZero("height", video.Height)
+
+	files := []tgbotapi.RequestFile{{Name: "video", Data: r.itemFile(video)}}
+	// Thumbnails can't be reused by file_id, they are uploaded with the video only
+	if video.ThumbnailPath != "" && video.FileID == "" {
+		files = append(files, tgbotapi.RequestFile{Name: "thumbnail", Data: tgbotapi.FilePath(video.ThumbnailPath)})
+	}
+
+	return r.uploadFiles(ctx, "sendVideo", params, files, groupID)
+}
+
+// sendAudio sends an audio with its tags, duration and thumbnail. Like for videos, the request is built
+// here since tgbotapi names the thumbnail by its old name.
+func (r *UploadRepository) sendAudio(ctx context.Context, audio entity.MediaItem, groupID int64) (tgbotapi.Message, error) {
+	params := tgbotapi.Params{}
+	params.AddNonZero64("chat_id", groupID)
+	params.AddNonEmpty("caption", audio.Caption)
+	if audio.Caption != "" {
+		params.AddNonEmpty("parse_mode", r.parseMode())
+	}
+	params.AddNonEmpty("title", audio.Title)
+	params.AddNonEmpty("performer", audio.Performer)
+	params.AddNonZero("duration", int(audio.Duration))
+
+	files := []tgbotapi.RequestFile{{Name: "audio", Data: r.itemFile(audio)}}
+	// Thumbnails can't be reused by file_id, they are uploaded with the audio only
+	if audio.ThumbnailPath != "" && audio.FileID == "" {
+		files = append(files, tgbotapi.RequestFile{Name: "thumbnail", Data: tgbotapi.FilePath(audio.ThumbnailPath)})
+	}
+
+	return r.uploadFiles(ctx, "sendAudio", params, files, groupID)
+}
+
+// uploadFiles performs the request built by the caller until it completes or the context is done,
+// returning the sent message
+func (r *UploadRepository) uploadFiles(ctx context.Context, method string, params tgbotapi.Params, files []tgbotapi.RequestFile, groupID int64) (tgbotapi.Message, error) {
+	var message tgbotapi.Message
+	err := r.retry(ctx, groupID, 1, func(bot *tgbotapi.BotAPI) error {
+		response, err := bot.UploadFiles(method, params, files)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(response.Result, &message)
+	})
+	return message, err
+}
+
+// parseMode is the Telegram formatting of captions, they are escaped for it by the caller
+func (r *UploadRepository) parseMode() string {
+	return string(r.environment.CaptionConfiguration.ParseMode)
+}
+
+// inputFile returns the file to upload. A local Bot API server reads the file from disk by its
+// absolute path, so the bytes are not sent over HTTP and the 50 MB limit does not apply.
+func (r *UploadRepository) inputFile(filePath string) tgbotapi.RequestFileData {
+	if !r.environment.TelegramConfiguration.LocalBotAPI {
+		return tgbotapi.FilePath(filePath)
+	}
+
+	absolutePath, err := filepath.Abs(filePath)
+	if err != nil {
+		return tgbotapi.FilePath(filePath)
+	}
+	return tgbotapi.FileURL("file://" + absolutePath)
+}
+
+// itemFile returns the file of an item, an item uploaded before is sent by its file_id
+func (r *UploadRepository) itemFile(item entity.MediaItem) tgbotapi.RequestFileData {
+	if item.FileID != "" {
+		return tgbotapi.FileID(item.FileID)
+	}
+	return r.inputFile(item.FilePath)
+}
+
+// uploadedVideo returns the file Telegram stored for a sent video
+func uploadedVideo(message tgbotapi.Message) *entity.UploadedMedia {
+	if message.Video == nil {
+		return &entity.UploadedMedia{}
+	}
+	return &entity.UploadedMedia{
+		FileID:       message.Video.FileID,
+		FileUniqueID: message.Video.FileUniqueID,
+	}
+}
+
+// uploadedMedia returns the files Telegram stored for sent media, in the order they were sent.
+// Photos are stored in several sizes, the largest one is taken.
+func uploadedMedia(messages []tgbotapi.Message) []entity.UploadedMedia {
+	uploaded := make([]entity.UploadedMedia, 0, len(messages))
+	for _, message := range messages {
+		switch {
+		case len(message.Photo) > 0:
+			photo := message.Photo[len(message.Photo)-1]
+			uploaded = append(uploaded, entity.UploadedMedia{FileID: photo.FileID, FileUniqueID: photo.FileUniqueID})
+		case message.Animation != nil:
+			uploaded = append(uploaded, entity.UploadedMedia{FileID: message.Animation.FileID, FileUniqueID: message.Animation.FileUniqueID})
+		case message.Audio != nil:
+			uploaded = append(uploaded, entity.UploadedMedia{FileID: message.Audio.FileID, FileUniqueID: message.Audio.FileUniqueID})
+		case message.Document != nil:
+			uploaded = append(uploaded, entity.UploadedMedia{FileID: message.Document.FileID, FileUniqueID: message.Document.FileUniqueID})
+		default:
+			uploaded = append(uploaded, *uploadedVideo(message))
+		}
+	}
+	return uploaded
+}
+
+// send performs the request until it completes or the context is done, returning the sent message
+func (r *UploadRepository) send(ctx context.Context, groupID int64, chattable tgbotapi.Chattable) (tgbotapi.Message, error) {
+	var message tgbotapi.Message
+	err := r.retry(ctx, groupID, 1, func(bot *tgbotapi.BotAPI) error {
+		var err error
+		message, err = bot.Send(chattable)
+		return err
+	})
+	return message, err
+}
+
+// retry runs the request until it succeeds, up to core.UploadMaxAttempts times. Telegram answers too many
+// requests with a flood wait telling how long to wait before the next one, and the request is repeated
+// after it, as it is after errors of the Telegram servers. Other errors are returned right away, a request
+// that failed on the way may have been delivered. Errors meaning the bot can't post to the chat at all are
+// wrapped in entity.ErrChatUnavailable. Every attempt waits for its turn under the rate limits, with the
+// priority of uploads. The request is made by a bot bound to the context, which aborts it when the context
+// is done, and a request aborted so is not repeated, Telegram may have received it.
+func (r *UploadRepository) retry(ctx context.Context, groupID int64, messages int, request func(bot *tgbotapi.BotAPI) error) error {
+	bot := r.botWithContext(ctx)
+
+	for attempt := 1; ; attempt++ {
+		if err := r.limiter.Wait(ctx, groupID, messages, ratelimiter.PriorityUpload); err != nil {
+			return err
+		}
+
+		err := request(bot)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if isChatUnavailable(err) {
+			return fmt.Errorf("%w: %v", entity.ErrChatUnavailable, err)
+		}
+
+		delay := retryDelay(err, attempt)
+		if delay == 0 || attempt >= core.UploadMaxAttempts {
+			return err
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("%w while waiting %s to retry: %v", ctx.Err(), delay, err)
+		}
+	}
+}
+
+// retryDelay returns how long to wait before repeating the failed request, 0 if it is not worth repeating
+func retryDelay(err error, attempt int) time.Duration {
+	var apiErr *tgbotapi.Error
+	if !errors.As(err, &apiErr) {
+		return 0
+	}
+
+	switch {
+	case apiErr.RetryAfter > 0:
+		return time.Duration(apiErr.RetryAfter) * time.Second
+	case errorCode(err) >= http.StatusInternalServerError:
+		return time.Duration(attempt) * core.UploadRetryDelay
+	default:
+		return 0
+	}
+}
+
+// isChatUnavailable reports whether the bot can't post to the chat whatever it sends: it was removed
+// from the group or lost the right to post media, the group was deleted or moved to a supergroup
+func isChatUnavailable(err error) bool {
+	var apiErr *tgbotapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	code := errorCode(err)
+	if code == http.StatusForbidden || apiErr.MigrateToChatID != 0 {
+		return true
+	}
+
+	message := strings.ToLower(apiErr.Message)
+	return code == http.StatusBadRequest && (strings.Contains(message, "chat not found") ||
+		strings.Contains(message, "not enough rights") ||
+		strings.Contains(message, "group chat was upgraded"))
+}
+
+// errorCode returns the HTTP status of a Telegram error, 0 for other errors. tgbotapi leaves the code of
+// errors of file uploads empty and Send drops the response carrying it, so it is taken from the description
+// then, which Telegram starts with the status text, e.g. "Forbidden: bot was kicked from the group chat".
+func errorCode(err error) int {
+	var apiErr *tgbotapi.Error
+	if !errors.As(err, &apiErr) {
+		return 0
+	}
+	if apiErr.Code != 0 {
+		return apiErr.Code
+	}
+
+	for prefix, code := range core.TelegramErrorDescriptionCodes {
+		if strings.HasPrefix(apiErr.Message, prefix) {
+			return code
+		}
+	}
+	return 0
+}
+
+// botWithContext returns a copy of the bot making its requests with the context.
+// tgbotapi builds its requests without a context, so they are bound to it by the HTTP client.
+func (r *UploadRepository) botWithContext(ctx context.Context) *tgbotapi.BotAPI {
+	bot := *r.botAPI
+	bot.Client = contextClient{ctx: ctx, client: r.botAPI.Client}
+	return &bot
+}
+
+// contextClient makes the requests of tgbotapi with a context, so they are aborted when it is done
+type contextClient struct {
+	ctx    context.Context
+	client tgbotapi.HTTPClient
+}
+
+func (c contextClient) Do(request *http.Request) (*http.Response, error) {
+	return c.client.Do(request.WithContext(c.ctx))
+}
\ No newline at end of file
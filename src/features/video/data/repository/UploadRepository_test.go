@@ -0,0 +1,367 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"tg-downloader/env"
+	"tg-downloader/src/core/ratelimiter"
+	"tg-downloader/src/features/video/domain/entity"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const testGroupID = -1001234567890
+
+// botAPIResponse is a response of the fake Bot API server
+type botAPIResponse struct {
+	status int
+	body   string
+	delay  time.Duration
+}
+
+// fakeBotAPI answers getMe and replays the responses queued for every other method, then succeeds.
+// The form of the last request to every method is kept.
+type fakeBotAPI struct {
+	mutex     sync.Mutex
+	responses map[string][]botAPIResponse
+	calls     map[string]int
+	forms     map[string]*multipart.Form
+	aborted   int
+}
+
+func newFakeBotAPI() *fakeBotAPI {
+	return &fakeBotAPI{
+		responses: make(map[string][]botAPIResponse),
+		calls:     make(map[string]int),
+		forms:     make(map[string]*multipart.Form),
+	}
+}
+
+func (f *fakeBotAPI) fail(method string, status int, body string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.responses[method] = append(f.responses[method], botAPIResponse{status: status, body: body})
+}
+
+// stall queues a response to the method delayed until the client gives up waiting for it
+func (f *fakeBotAPI) stall(method string, delay time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.responses[method] = append(f.responses[method], botAPIResponse{status: http.StatusInternalServerError, body: `{"ok":false,"error_code":500,"description":"Internal Server Error"}`, delay: delay})
+}
+
+func (f *fakeBotAPI) abortedCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.aborted
+}
+
+func (f *fakeBotAPI) callCount(method string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.calls[method]
+}
+
+// lastForm returns the form of the last multipart request to the method, nil if there was none
+func (f *fakeBotAPI) lastForm(method string) *multipart.Form {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.forms[method]
+}
+
+func (f *fakeBotAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+
+	var form *multipart.Form
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") && r.ParseMultipartForm(1<<20) == nil {
+		form = r.MultipartForm
+	}
+
+	f.mutex.Lock()
+	f.calls[method]++
+	if form != nil {
+		f.forms[method] = form
+	}
+	var response *botAPIResponse
+	if queued := f.responses[method]; len(queued) > 0 {
+		response = &queued[0]
+		f.responses[method] = queued[1:]
+	}
+	f.mutex.Unlock()
+
+	if response != nil && response.delay > 0 {
+		// The server notices the client went away once it has read the request
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-time.After(response.delay):
+		case <-r.Context().Done():
+			f.mutex.Lock()
+			f.aborted++
+			f.mutex.Unlock()
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if response != nil {
+		w.WriteHeader(response.status)
+		w.Write([]byte(response.body))
+		return
+	}
+
+	switch method {
+	case "getMe":
+		w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"bot","username":"bot"}}`))
+	case "sendMediaGroup":
+		w.Write([]byte(`{"ok":true,"result":[{"message_id":1,"photo":[{"file_id":"a","file_unique_id":"a"}]},{"message_id":2,"photo":[{"file_id":"b","file_unique_id":"b"}]}]}`))
+	case "sendVideo":
+		w.Write([]byte(`{"ok":true,"result":{"message_id":1,"video":{"file_id":"v","file_unique_id":"v"}}}`))
+	default:
+		w.Write([]byte(`{"ok":true,"result":{"message_id":1,"photo":[{"file_id":"p","file_unique_id":"p"}]}}`))
+	}
+}
+
+func newTestUploadRepository(t *testing.T) (*UploadRepository, *fakeBotAPI) {
+	t.Helper()
+
+	fake := newFakeBotAPI()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	botAPI, err := tgbotapi.NewBotAPIWithClient("123:token", server.URL+"/bot%s/%s", server.Client())
+	if err != nil {
+		t.Fatalf("failed to create bot: %v", err)
+	}
+
+	environment := env.TGDownloader{}
+	limiter := ratelimiter.NewRateLimiter(env.RateLimitConfiguration{
+		GlobalRequestsPerSecond: 1000,
+		GroupRequestsPerMinute:  1000,
+		UploadReservePercent:    20,
+	})
+
+	return &UploadRepository{environment: environment, botAPI: botAPI, limiter: limiter}, fake
+}
+
+func writeTestFile(t *testing.T, name string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte("media"), 0o644); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+func TestUploadVideoReportsUnavailableChat(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"kicked", `{"ok":false,"error_code":403,"description":"Forbidden: bot was kicked from the supergroup chat"}`},
+		{"chat not found", `{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`},
+		{"migrated", `{"ok":false,"error_code":400,"description":"Bad Request: group chat was upgraded to a supergroup chat","parameters":{"migrate_to_chat_id":-100987}}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo, fake := newTestUploadRepository(t)
+			status := http.StatusBadRequest
+			if strings.Contains(test.body, "Forbidden") {
+				status = http.StatusForbidden
+			}
+			fake.fail("sendVideo", status, test.body)
+
+			video := &entity.VideoProcessResult{FilePath: writeTestFile(t, "video.mp4")}
+			_, err := repo.UploadVideo(context.Background(), video, "", testGroupID)
+			if !errors.Is(err, entity.ErrChatUnavailable) {
+				t.Fatalf("expected ErrChatUnavailable, got %v", err)
+			}
+			if calls := fake.callCount("sendVideo"); calls != 1 {
+				t.Fatalf("expected a single sendVideo call, got %d", calls)
+			}
+		})
+	}
+}
+
+func TestUploadVideoRetriesFloodWait(t *testing.T) {
+	repo, fake := newTestUploadRepository(t)
+	fake.fail("sendVideo", http.StatusTooManyRequests, `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 1","parameters":{"retry_after":1}}`)
+
+	video := &entity.VideoProcessResult{FilePath: writeTestFile(t, "video.mp4")}
+	uploaded, err := repo.UploadVideo(context.Background(), video, "", testGroupID)
+	if err != nil {
+		t.Fatalf("expected the upload to succeed after the flood wait, got %v", err)
+	}
+	if uploaded.FileID != "v" {
+		t.Fatalf("expected file_id v, got %q", uploaded.FileID)
+	}
+	if calls := fake.callCount("sendVideo"); calls != 2 {
+		t.Fatalf("expected 2 sendVideo calls, got %d", calls)
+	}
+}
+
+func TestUploadIsAbortedWithContext(t *testing.T) {
+	repo, fake := newTestUploadRepository(t)
+	fake.stall("sendVideo", 5*time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	video := &entity.VideoProcessResult{FilePath: writeTestFile(t, "video.mp4")}
+	start := time.Now()
+	_, err := repo.UploadVideo(ctx, video, "", testGroupID)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the upload to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected the upload to be aborted on timeout, it took %s", elapsed)
+	}
+
+	// The request that timed out may have reached Telegram, so it is not sent again
+	if calls := fake.callCount("sendVideo"); calls != 1 {
+		t.Fatalf("expected a single sendVideo call, got %d", calls)
+	}
+	deadline := time.Now().Add(time.Second)
+	for fake.abortedCount() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fake.abortedCount() != 1 {
+		t.Fatal("expected the request in flight to be aborted")
+	}
+}
+
+func TestUploadErrorsAreClassifiedWithoutCode(t *testing.T) {
+	repo, fake := newTestUploadRepository(t)
+	fake.fail("sendVideo", http.StatusInternalServerError, `{"ok":false,"error_code":500,"description":"Internal Server Error"}`)
+	fake.fail("sendPhoto", http.StatusForbidden, `{"ok":false,"error_code":403,"description":"Forbidden: bot is not a member of the supergroup chat"}`)
+
+	// UploadFiles leaves the code of the error empty, Send drops the response with it
+	_, uploadErr := repo.botAPI.UploadFiles("sendVideo", tgbotapi.Params{}, []tgbotapi.RequestFile{{Name: "video", Data: tgbotapi.FilePath(writeTestFile(t, "video.mp4"))}})
+	if delay := retryDelay(uploadErr, 1); delay <= 0 {
+		t.Fatalf("expected a server error to be retried, got %v for %v", delay, uploadErr)
+	}
+
+	_, sendErr := repo.botAPI.Send(tgbotapi.NewPhoto(testGroupID, tgbotapi.FilePath(writeTestFile(t, "photo.jpg"))))
+	if !isChatUnavailable(sendErr) {
+		t.Fatalf("expected the chat to be unavailable for %v", sendErr)
+	}
+}
+
+func TestUploadMediaFallsBackToSingleItems(t *testing.T) {
+	repo, fake := newTestUploadRepository(t)
+	fake.fail("sendMediaGroup", http.StatusBadRequest, `{"ok":false,"error_code":400,"description":"Bad Request: failed to send message #1 with the error message \"wrong file identifier\""}`)
+
+	items := []entity.MediaItem{
+		{Type: entity.MediaTypePhoto, FilePath: writeTestFile(t, "first.jpg")},
+		{Type: entity.MediaTypePhoto, FilePath: writeTestFile(t, "second.jpg")},
+	}
+	uploaded, err := repo.UploadMedia(context.Background(), items, testGroupID)
+	if err != nil {
+		t.Fatalf("expected the items to be sent one by one, got %v", err)
+	}
+	if len(uploaded) != len(items) {
+		t.Fatalf("expected %d uploaded items, got %d", len(items), len(uploaded))
+	}
+	if calls := fake.callCount("sendPhoto"); calls != len(items) {
+		t.Fatalf("expected %d sendPhoto calls, got %d", len(items), calls)
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{&tgbotapi.Error{Code: 429, Message: "Too Many Requests: retry after 5"}, 429},
+		{&tgbotapi.Error{Message: "Forbidden: bot was blocked by the user"}, 403},
+		{&tgbotapi.Error{Message: "Bad Request: chat not found"}, 400},
+		{&tgbotapi.Error{Message: "Bad Gateway"}, 502},
+		{&tgbotapi.Error{Message: "something else"}, 0},
+		{errors.New("connection reset"), 0},
+	}
+
+	for _, test := range tests {
+		if code := errorCode(test.err); code != test.code {
+			t.Errorf("errorCode(%v) = %d, expected %d", test.err, code, test.code)
+		}
+	}
+}
+
+func TestUploadMediaSendsAudioThumbnail(t *testing.T) {
+	repo, fake := newTestUploadRepository(t)
+
+	items := []entity.MediaItem{{
+		Type:          entity.MediaTypeAudio,
+		FilePath:      writeTestFile(t, "song.mp3"),
+		ThumbnailPath: writeTestFile(t, "song.jpg"),
+		Title:         "Song",
+	}}
+	if _, err := repo.UploadMedia(context.Background(), items, testGroupID); err != nil {
+		t.Fatalf("expected the audio to be sent, got %v", err)
+	}
+
+	form := fake.lastForm("sendAudio")
+	if form == nil {
+		t.Fatal("expected the audio to be uploaded as a file")
+	}
+	if _, ok := form.File["thumbnail"]; !ok {
+		t.Fatalf("expected the thumbnail to be sent as thumbnail, got files %v", form.File)
+	}
+	if _, ok := form.File["thumb"]; ok {
+		t.Fatal("expected the deprecated thumb parameter not to be sent")
+	}
+	if title := form.Value["title"]; len(title) != 1 || title[0] != "Song" {
+		t.Fatalf("expected the title to be sent, got %v", title)
+	}
+}
+
+func TestUploadMediaSendsAlbumThumbnails(t *testing.T) {
+	repo, fake := newTestUploadRepository(t)
+
+	items := []entity.MediaItem{
+		{Type: entity.MediaTypeVideo, FilePath: writeTestFile(t, "part000.mp4"), ThumbnailPath: writeTestFile(t, "part000.jpg"), Width: 1280, Height: 720, Duration: 59.6, Caption: "Part 1/2"},
+		{Type: entity.MediaTypeVideo, FilePath: writeTestFile(t, "part001.mp4"), ThumbnailPath: writeTestFile(t, "part001.jpg"), Width: 1280, Height: 720, Duration: 30.2, Caption: "Part 2/2"},
+	}
+	if _, err := repo.UploadMedia(context.Background(), items, testGroupID); err != nil {
+		t.Fatalf("expected the album to be sent, got %v", err)
+	}
+
+	form := fake.lastForm("sendMediaGroup")
+	if form == nil {
+		t.Fatal("expected the album to be uploaded")
+	}
+	for _, name := range []string{"file-0", "file-0-thumbnail", "file-1", "file-1-thumbnail"} {
+		if _, ok := form.File[name]; !ok {
+			t.Fatalf("expected %s to be uploaded, got files %v", name, form.File)
+		}
+	}
+
+	var media []albumEntry
+	if err := json.Unmarshal([]byte(form.Value["media"][0]), &media); err != nil {
+		t.Fatalf("failed to read the media of the album: %v", err)
+	}
+	expected := []albumEntry{
+		{Type: "video", Media: "attach://file-0", Thumbnail: "attach://file-0-thumbnail", Caption: "Part 1/2", Width: 1280, Height: 720, Duration: 60, SupportsStreaming: true},
+		{Type: "video", Media: "attach://file-1", Thumbnail: "attach://file-1-thumbnail", Caption: "Part 2/2", Width: 1280, Height: 720, Duration: 30, SupportsStreaming: true},
+	}
+	if len(media) != len(expected) {
+		t.Fatalf("expected %d album entries, got %d", len(expected), len(media))
+	}
+	for i := range expected {
+		if media[i] != expected[i] {
+			t.Errorf("album entry %d = %+v, expected %+v", i, media[i], expected[i])
+		}
+	}
+}
\ No newline at end of file
@@ -0,0 +1,358 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"tg-downloader/env"
+	"tg-downloader/src/core"
+	"tg-downloader/src/features/video/domain/entity"
+	"tg-downloader/src/features/video/domain/repository"
+	"time"
+)
+
+// compressionLadder maps a video bitrate in kbit/s to the highest resolution worth encoding at it
+var compressionLadder = []struct {
+	minBitrateKbps int
+	height         int
+}{
+	{minBitrateKbps: 4000, height: 1080},
+	{minBitrateKbps: 2000, height: 720},
+	{minBitrateKbps: 1000, height: 480},
+	{minBitrateKbps: 500, height: 360},
+	{minBitrateKbps: 0, height: 240},
+}
+
+type VideoCompressRepository struct {
+	environment env.TGDownloader
+}
+
+func NewVideoCompressRepository(environment env.TGDownloader) repository.IVideoCompressRepository {
+	return &VideoCompressRepository{
+		environment: environment,
+	}
+}
+
+// CompressVideo re-encodes the video with two-pass H.264/AAC at a bitrate computed from its duration,
+// lowering the bitrate and resolution until the file fits into maxSize.
+func (r *VideoCompressRepository) CompressVideo(ctx context.Context, filePath string, duration float64, maxSize int64) (*entity.CompressionResult, error) {
+	config := r.environment.CompressionConfiguration
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read video: %w", err)
+	}
+
+	if duration <= 0 {
+		duration, err = r.probeDuration(ctx, filePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	targetSize := maxSize * core.CompressionTargetPercent / 100
+	videoBitrate := int(float64(targetSize*8)/duration/1000) - config.AudioBitrateKbps
+	outputPath := strings.TrimSuffix(filePath, filepath.Ext(filePath)) + ".compressed.mp4"
+
+	for attempt := 1; attempt <= config.MaxAttempts; attempt++ {
+		if videoBitrate < config.MinVideoBitrateKbps {
+			return nil, fmt.Errorf("%w: it would need %d kbit/s for %s of video",
+				entity.ErrCompressionInsufficient, videoBitrate, time.Duration(duration)*time.Second)
+		}
+
+		height := heightForBitrate(videoBitrate)
+		if err := r.encode(ctx, filePath, outputPath, videoBitrate, height); err != nil {
+			return nil, err
+		}
+
+		compressed, err := os.Stat(outputPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read compressed video: %w", err)
+		}
+
+		if compressed.Size() <= maxSize {
+			return &entity.CompressionResult{
+				FilePath:         outputPath,
+				FileSize:         compressed.Size(),
+				OriginalSize:     info.Size(),
+				VideoBitrateKbps: videoBitrate,
+				Height:           height,
+				Attempts:         attempt,
+			}, nil
+		}
+
+		// The encoder overshot the target, scale the bitrate down by the overshoot
+		videoBitrate = int(float64(videoBitrate) * float64(targetSize) / float64(compressed.Size()))
+	}
+
+	os.Remove(outputPath)
+	return nil, fmt.Errorf("%w: still too large after %d attempts", entity.ErrCompressionInsufficient, config.MaxAttempts)
+}
+
+// SplitVideo cuts the video on keyframes into the smallest number of sequential parts that each fit
+// into maxSize, without re-encoding. Parts are written to a directory next to the video.
+func (r *VideoCompressRepository) SplitVideo(ctx context.Context, filePath string, duration float64, maxSize int64, maxParts int) ([]entity.VideoPart, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(r.environment.CompressionConfiguration.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read video: %w", err)
+	}
+
+	if duration <= 0 {
+		duration, err = r.probeDuration(ctx, filePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	targetSize := maxSize * core.CompressionTargetPercent / 100
+	partsDir := filepath.Join(filepath.Dir(filePath), "parts")
+
+	// Bitrate is rarely even, so parts are cut shorter until every one of them fits
+	for count := int((info.Size() + targetSize - 1) / targetSize); count <= maxParts; count++ {
+		if err := os.RemoveAll(partsDir); err != nil {
+			return nil, fmt.Errorf("failed to clean up parts: %w", err)
+		}
+		if err := os.MkdirAll(partsDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create parts directory: %w", err)
+		}
+
+		segmentTime := duration / float64(count)
+		err := r.runFfmpeg(ctx, []string{
+			"-y", "-i", filePath,
+			// Only the streams Telegram plays, subtitle and data streams break the segment muxer
+			"-map", "0:v:0",
+			"-map", "0:a?",
+			"-c", "copy",
+			"-f", "segment",
+			"-segment_time", strconv.FormatFloat(segmentTime, 'f', 3, 64),
+			"-reset_timestamps", "1",
+			filepath.Join(partsDir, "part%03d"+filepath.Ext(filePath)),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("splitting failed: %w", err)
+		}
+
+		parts, fits, err := r.collectParts(partsDir, maxSize)
+		if err != nil {
+			return nil, err
+		}
+		if fits {
+			return parts, nil
+		}
+	}
+
+	os.RemoveAll(partsDir)
+	return nil, fmt.Errorf("%w: it does not fit into %d parts", entity.ErrCompressionInsufficient, maxParts)
+}
+
+// collectParts lists the parts written by the segment muxer in order and reports whether all of them fit
+func (r *VideoCompressRepository) collectParts(partsDir string, maxSize int64) ([]entity.VideoPart, bool, error) {
+	// Segment file names are zero-padded, so the directory order is the playback order
+	entries, err := os.ReadDir(partsDir)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read parts: %w", err)
+	}
+
+	parts := make([]entity.VideoPart, 0, len(entries))
+	fits := true
+	for i, dirEntry := range entries {
+		info, err := dirEntry.Info()
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read part: %w", err)
+		}
+		if info.Size() > maxSize {
+			fits = false
+		}
+
+		parts = append(parts, entity.VideoPart{
+			FilePath: filepath.Join(partsDir, dirEntry.Name()),
+			FileSize: info.Size(),
+			Number:   i + 1,
+			Total:    len(entries),
+		})
+	}
+
+	return parts, fits, nil
+}
+
+// encode runs both ffmpeg passes, the pass log is kept next to the output file
+func (r *VideoCompressRepository) encode(ctx context.Context, inputPath string, outputPath string, videoBitrate int, height int) error {
+	config := r.environment.CompressionConfiguration
+	passLogFile := filepath.Join(filepath.Dir(outputPath), "ffmpeg2pass")
+
+	videoArgs := []string{"-y", "-i", inputPath}
+	if config.Threads > 0 {
+		videoArgs = append(videoArgs, "-threads", strconv.Itoa(config.Threads))
+	}
+	videoArgs = append(videoArgs,
+		"-c:v", "libx264",
+		"-preset", config.Preset,
+		"-b:v", fmt.Sprintf("%dk", videoBitrate),
+		"-vf", fmt.Sprintf("scale=-2:'min(%d,ih)'", height),
+		"-passlogfile", passLogFile,
+	)
+
+	firstPass := append(append([]string{}, videoArgs...), "-pass", "1", "-an", "-f", "null", os.DevNull)
+	if err := r.runFfmpeg(ctx, firstPass); err != nil {
+		return fmt.Errorf("first encoding pass failed: %w", err)
+	}
+
+	secondPass := append(append([]string{}, videoArgs...),
+		"-pass", "2",
+		"-c:a", "aac",
+		"-b:a", fmt.Sprintf("%dk", config.AudioBitrateKbps),
+		"-movflags", "+faststart",
+		outputPath,
+	)
+	if err := r.runFfmpeg(ctx, secondPass); err != nil {
+		return fmt.Errorf("second encoding pass failed: %w", err)
+	}
+
+	return nil
+}
+
+// runFfmpeg runs ffmpeg, it is killed when the context is done
+func (r *VideoCompressRepository) runFfmpeg(ctx context.Context, args []string) error {
+	cmd := exec.CommandContext(ctx, r.environment.CompressionConfiguration.FfmpegExecutablePath, args...)
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, lastLine(string(output)))
+	}
+	return nil
+}
+
+// probeDuration reads the duration of a video in seconds with ffprobe
+func (r *VideoCompressRepository) probeDuration(ctx context.Context, filePath string) (float64, error) {
+	cmd := exec.CommandContext(ctx, r.environment.CompressionConfiguration.FfprobeExecutablePath,
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		filePath,
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to probe video duration: %w", err)
+	}
+
+	duration, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("unknown video duration %q", strings.TrimSpace(string(output)))
+	}
+
+	return duration, nil
+}
+
+// ffprobeOutput is the part of the ffprobe JSON output InspectVideo reads
+type ffprobeOutput struct {
+	Streams []struct {
+		Width        int               `json:"width"`
+		Height       int               `json:"height"`
+		Tags         map[string]string `json:"tags"`
+		SideDataList []struct {
+			Rotation int `json:"rotation"`
+		} `json:"side_data_list"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+// InspectVideo reads the dimensions of the first video stream and the duration with ffprobe.
+// Videos recorded on phones are often stored rotated, the dimensions are swapped to how they are displayed.
+func (r *VideoCompressRepository) InspectVideo(ctx context.Context, filePath string) (*entity.VideoAttributes, error) {
+	cmd := exec.CommandContext(ctx, r.environment.CompressionConfiguration.FfprobeExecutablePath,
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=width,height:stream_tags=rotate:stream_side_data=rotation:format=duration",
+		"-of", "json",
+		filePath,
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect video: %w", err)
+	}
+
+	var probe ffprobeOutput
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return nil, fmt.Errorf("failed to read ffprobe output: %w", err)
+	}
+	if len(probe.Streams) == 0 || probe.Streams[0].Width <= 0 || probe.Streams[0].Height <= 0 {
+		return nil, fmt.Errorf("no video stream in %s", filepath.Base(filePath))
+	}
+
+	stream := probe.Streams[0]
+	rotation, _ := strconv.Atoi(stream.Tags["rotate"])
+	for _, sideData := range stream.SideDataList {
+		if sideData.Rotation != 0 {
+			rotation = sideData.Rotation
+		}
+	}
+
+	attributes := &entity.VideoAttributes{Width: stream.Width, Height: stream.Height}
+	if rotation%180 != 0 {
+		attributes.Width, attributes.Height = stream.Height, stream.Width
+	}
+	// The duration is optional, e.g. streams cut without an index don't report it
+	if duration, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil && duration > 0 {
+		attributes.Duration = duration
+	}
+
+	return attributes, nil
+}
+
+// ExtractThumbnail saves a frame from the beginning of the video, scaled down to fit a Telegram thumbnail.
+// The very first frame is skipped as it is often black.
+func (r *VideoCompressRepository) ExtractThumbnail(ctx context.Context, filePath string, duration float64, thumbnailPath string) error {
+	position := min(1, duration/2)
+
+	args := []string{
+		"-y",
+		"-ss", strconv.FormatFloat(position, 'f', 3, 64),
+		"-i", filePath,
+		"-frames:v", "1",
+		"-vf", fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease", core.VideoThumbnailSize, core.VideoThumbnailSize),
+		"-q:v", "4",
+		thumbnailPath,
+	}
+	if err := r.runFfmpeg(ctx, args); err != nil {
+		return fmt.Errorf("failed to extract thumbnail: %w", err)
+	}
+
+	if _, err := os.Stat(thumbnailPath); err != nil {
+		return fmt.Errorf("no thumbnail was extracted: %w", err)
+	}
+
+	return nil
+}
+
+// heightForBitrate picks the resolution from compressionLadder for the video bitrate
+func heightForBitrate(videoBitrate int) int {
+	for _, step := range compressionLadder {
+		if videoBitrate >= step.minBitrateKbps {
+			return step.height
+		}
+	}
+	return compressionLadder[len(compressionLadder)-1].height
+}
+
+// lastLine returns the last non-empty line of a command output, ffmpeg puts the actual error there
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
\ No newline at end of file
@@ -1,11 +1,22 @@
 package repository
 
 import (
+	"cmp"
 	"context"
+	"encoding/json"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"tg-downloader/env"
 	"tg-downloader/src/core"
 	"tg-downloader/src/features/video/domain/entity"
@@ -54,94 +65,466 @@ func (r *VideoDownloadRepository) ValidateURL(url string) (bool, string, error)
 	return false, "", fmt.Errorf("unsupported video format. Supported formats:\n%s", supportedFormats)
 }
 
-func (r *VideoDownloadRepository) DownloadVideo(url string, outputDir string) (*entity.VideoProcessResult, error) {
+// ProbeVideo reads the metadata of a link without downloading it
+func (r *VideoDownloadRepository) ProbeVideo(ctx context.Context, url string) (*entity.VideoMetadata, error) {
+	dl := ytdlp.New().
+		SetExecutable(r.environment.CommonDownloaderConfiguration.YtdlpExecutablePath).
+		Format(r.environment.VideoDownloaderConfiguration.VideoQuality).
+		DumpJSON().
+		NoPlaylist().
+		PlaylistItems(fmt.Sprintf("1:%d", core.MaxMediaItemsPerLink)).
+		NoCheckCertificates()
+
+	dl = r.applyYtdlpOptions(dl)
+
+	result, err := dl.Run(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("metadata probe failed: %w", err)
+	}
+
+	infos, err := result.GetExtractedInfo()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metadata: %w", err)
+	}
+	if len(infos) == 0 {
+		return nil, fmt.Errorf("yt-dlp did not report any metadata")
+	}
+
+	return r.convertMetadata(infos), nil
+}
+
+// DownloadVideo downloads the link into outputDir. An empty format keeps the configured video quality.
+func (r *VideoDownloadRepository) DownloadVideo(ctx context.Context, url string, outputDir string, format string, onProgress entity.DownloadProgressFunc) (*entity.VideoProcessResult, error) {
 	// Ensure output directory exists
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
 		return &entity.VideoProcessResult{
-			Success: false,
-			Error:   fmt.Errorf("failed to create output directory: %w", err),
+			Success:     false,
+			Error:       fmt.Errorf("failed to create output directory: %w", err),
+			FailureKind: entity.FailureKindTransient,
 		}, err
 	}
 
+	if format == "" {
+		format = r.environment.VideoDownloaderConfiguration.VideoQuality
+	}
+
 	// Configure yt-dlp options with configured executable path
 	dl := ytdlp.New().
 		SetExecutable(r.environment.CommonDownloaderConfiguration.YtdlpExecutablePath).
-		Format(r.environment.VideoDownloaderConfiguration.VideoQuality).
-		Output(filepath.Join(outputDir, "%(title)s.%(ext)s")).
+		Format(format).
+		Output(filepath.Join(outputDir, core.DownloadOutputTemplate)).
+		Print(core.DownloadedFilePrintTemplate).
+		NoPlaylist().
+		PlaylistItems(fmt.Sprintf("1:%d", core.MaxMediaItemsPerLink)).
+		NoSimulate().
 		NoCheckCertificates()
 
-	// Add format specification if needed
-	if r.environment.VideoDownloaderConfiguration.OutputFormat != "" {
-		dl = dl.RecodeVideo(r.environment.VideoDownloaderConfiguration.OutputFormat)
+	result, err := r.runDownload(ctx, dl, url, onProgress)
+	if err != nil {
+		return result, err
+	}
+
+	// Recoded here rather than by yt-dlp, which would turn the images of a post into videos as well
+	if outputFormat := r.environment.VideoDownloaderConfiguration.OutputFormat; outputFormat != "" {
+		if err := r.recodeVideos(ctx, result.Items, outputFormat); err != nil {
+			return &entity.VideoProcessResult{
+				Success:     false,
+				Error:       fmt.Errorf("failed to recode video: %w", err),
+				FailureKind: entity.FailureKindTransient,
+			}, err
+		}
+	}
+
+	var totalSize int64
+	for _, item := range result.Items {
+		totalSize += item.FileSize
 	}
 
+	// The size limit is enforced by the caller, which may re-encode the file to fit
+	first := result.Items[0]
+	result.FilePath = first.FilePath
+	result.FileName = filepath.Base(first.FilePath)
+	result.FileSize = totalSize
+	result.Duration = first.Duration
+	return result, nil
+}
+
+// DownloadAudio extracts the audio of the link into outputDir in the configured format. Only the first
+// item of a multi-item link is taken. The title and performer are read from the tags yt-dlp reports.
+func (r *VideoDownloadRepository) DownloadAudio(ctx context.Context, url string, outputDir string, onProgress entity.DownloadProgressFunc) (*entity.VideoProcessResult, error) {
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return &entity.VideoProcessResult{
+			Success:     false,
+			Error:       fmt.Errorf("failed to create output directory: %w", err),
+			FailureKind: entity.FailureKindTransient,
+		}, err
+	}
+
+	config := r.environment.AudioDownloaderConfiguration
+
+	dl := ytdlp.New().
+		SetExecutable(r.environment.CommonDownloaderConfiguration.YtdlpExecutablePath).
+		Format("bestaudio/best").
+		ExtractAudio().
+		AudioFormat(string(config.AudioFormat)).
+		AudioQuality(config.AudioQuality).
+		EmbedMetadata().
+		Output(filepath.Join(outputDir, core.DownloadOutputTemplate)).
+		Print(core.DownloadedFilePrintTemplate).
+		NoPlaylist().
+		PlaylistItems("1").
+		NoSimulate().
+		NoCheckCertificates()
+
+	// The thumbnail is kept next to the audio after embedding, it becomes the thumbnail of the Telegram audio
+	if config.EmbedThumbnail {
+		dl = dl.
+			EmbedThumbnail().
+			WriteThumbnail().
+			ConvertThumbnails(core.AudioThumbnailFormat).
+			PostProcessorArgs(core.AudioThumbnailPostProcessorArgs)
+	}
+
+	result, err := r.runDownload(ctx, dl, url, onProgress)
+	if err != nil {
+		return result, err
+	}
+
+	audio := result.Items[0]
+	audio.Type = entity.MediaTypeAudio
+	if config.EmbedThumbnail {
+		thumbnailPath := strings.TrimSuffix(audio.FilePath, filepath.Ext(audio.FilePath)) + "." + core.AudioThumbnailFormat
+		if _, err := os.Stat(thumbnailPath); err == nil {
+			audio.ThumbnailPath = thumbnailPath
+		}
+	}
+
+	result.FilePath = audio.FilePath
+	result.FileName = filepath.Base(audio.FilePath)
+	result.FileSize = audio.FileSize
+	result.Duration = audio.Duration
+	result.Items = []entity.MediaItem{audio}
+	return result, nil
+}
+
+// runDownload runs yt-dlp and collects the downloaded files into a successful result with the items
+// and the metadata of the link. On failure it returns the result describing the failure together with the error.
+func (r *VideoDownloadRepository) runDownload(ctx context.Context, dl *ytdlp.Command, url string, onProgress entity.DownloadProgressFunc) (*entity.VideoProcessResult, error) {
 	// Apply yt-dlp configuration options
 	dl = r.applyYtdlpOptions(dl)
 
-	// Execute download
-	_, err := dl.Run(context.Background(), url)
+	if onProgress != nil {
+		dl = dl.ProgressFunc(core.DownloadProgressInterval, func(update ytdlp.ProgressUpdate) {
+			onProgress(r.convertProgress(update))
+		})
+	}
+
+	// Execute download, yt-dlp is killed when the context is done
+	result, err := dl.Run(ctx, url)
+	if ctx.Err() != nil {
+		return &entity.VideoProcessResult{
+			Success:     false,
+			Error:       fmt.Errorf("download interrupted: %w", ctx.Err()),
+			FailureKind: entity.FailureKindTransient,
+		}, ctx.Err()
+	}
 	if err != nil {
 		return &entity.VideoProcessResult{
-			Success: false,
-			Error:   fmt.Errorf("download failed: %w", err),
+			Success:     false,
+			Error:       fmt.Errorf("download failed: %w", err),
+			FailureKind: r.classifyDownloadError(err),
 		}, err
 	}
 
-	// Find the downloaded file by scanning the output directory
-	var downloadedFile string
-	var fileSize int64
-
-	entries, err := os.ReadDir(outputDir)
+	// Take the downloaded files from what yt-dlp printed, not from the directory contents,
+	// so intermediate files are never sent and the items keep the order of the post
+	files, err := r.collectDownloadedFiles(result.Stdout)
 	if err != nil {
 		return &entity.VideoProcessResult{
-			Success: false,
-			Error:   fmt.Errorf("failed to read output directory: %w", err),
-		}, err
+			Success:     false,
+			Error:       fmt.Errorf("no file was downloaded: %w", err),
+			FailureKind: entity.FailureKindTransient,
+		}, fmt.Errorf("download result empty")
+	}
+
+	items := make([]entity.MediaItem, 0, len(files))
+	for _, file := range files {
+		items = append(items, entity.MediaItem{
+			Type:      mediaType(file.FilePath, file.size),
+			FilePath:  file.FilePath,
+			FileSize:  file.size,
+			Duration:  file.Duration,
+			Title:     cmp.Or(file.Track, file.Title),
+			Performer: cmp.Or(file.Artist, file.Uploader),
+		})
 	}
 
-	// Find the most recently created file
-	var latestFile os.FileInfo
-	var latestPath string
-	for _, entry := range entries {
-		info, err := entry.Info()
+	// The first file stands for the whole post in the caption
+	return &entity.VideoProcessResult{
+		Success:  true,
+		Title:    files[0].Title,
+		Uploader: files[0].Uploader,
+		Items:    items,
+	}, nil
+}
+
+// recodeVideos re-encodes the video items which are not in outputFormat yet with ffmpeg and replaces
+// them by the result. Other items are kept as they were downloaded.
+func (r *VideoDownloadRepository) recodeVideos(ctx context.Context, items []entity.MediaItem, outputFormat string) error {
+	for i := range items {
+		item := &items[i]
+		extension := filepath.Ext(item.FilePath)
+		if item.Type != entity.MediaTypeVideo || strings.EqualFold(strings.TrimPrefix(extension, "."), outputFormat) {
+			continue
+		}
+
+		outputPath := strings.TrimSuffix(item.FilePath, extension) + "." + outputFormat
+		cmd := exec.CommandContext(ctx, r.environment.CompressionConfiguration.FfmpegExecutablePath,
+			"-y",
+			"-i", item.FilePath,
+			"-map", "0:v:0",
+			"-map", "0:a?",
+			outputPath,
+		)
+		output, err := cmd.CombinedOutput()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			os.Remove(outputPath)
+			return fmt.Errorf("%w: %s", err, lastLine(string(output)))
+		}
+
+		info, err := os.Stat(outputPath)
+		if err != nil {
+			return fmt.Errorf("failed to read recoded file: %w", err)
+		}
+
+		os.Remove(item.FilePath)
+		item.FilePath = outputPath
+		item.FileSize = info.Size()
+	}
+
+	return nil
+}
+
+// printedFile is the JSON printed by yt-dlp for core.DownloadedFilePrintTemplate
+type printedFile struct {
+	FilePath string  `json:"filepath"`
+	Duration float64 `json:"duration"`
+	Title    string  `json:"title"`
+	Track    string  `json:"track"`
+	Artist   string  `json:"artist"`
+	Uploader string  `json:"uploader"`
+
+	size int64
+}
+
+// collectDownloadedFiles lists the files printed by yt-dlp to stdout in the order they were downloaded
+func (r *VideoDownloadRepository) collectDownloadedFiles(stdout string) ([]printedFile, error) {
+	var files []printedFile
+	seen := make(map[string]bool)
+
+	for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+		var file printedFile
+		if err := json.Unmarshal([]byte(strings.TrimSpace(line)), &file); err != nil || file.FilePath == "" {
+			continue
+		}
+		if seen[file.FilePath] {
+			continue
+		}
+		seen[file.FilePath] = true
+
+		info, err := os.Stat(file.FilePath)
 		if err != nil {
+			return nil, fmt.Errorf("failed to read downloaded file: %w", err)
+		}
+
+		file.size = info.Size()
+		files = append(files, file)
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("yt-dlp did not report a downloaded file")
+	}
+
+	return files, nil
+}
+
+// mediaType tells the kind of a downloaded file by its MIME type. Images over the limits of Telegram
+// photos are sent as documents, files of unknown type as videos.
+func mediaType(filePath string, fileSize int64) entity.MediaType {
+	contentType := detectContentType(filePath)
+
+	switch {
+	case contentType == "image/gif":
+		return entity.MediaTypeAnimation
+	case strings.HasPrefix(contentType, "image/"):
+		if !fitsPhotoLimits(filePath, fileSize) {
+			return entity.MediaTypeDocument
+		}
+		return entity.MediaTypePhoto
+	case strings.HasPrefix(contentType, "audio/"):
+		return entity.MediaTypeAudio
+	default:
+		return entity.MediaTypeVideo
+	}
+}
+
+// detectContentType sniffs the MIME type from the file contents. When the contents are not
+// recognised, the type is guessed from the extension.
+func detectContentType(filePath string) string {
+	contentType := "application/octet-stream"
+
+	if file, err := os.Open(filePath); err == nil {
+		header := make([]byte, core.ContentSniffLength)
+		n, _ := io.ReadFull(file, header)
+		file.Close()
+		contentType = http.DetectContentType(header[:n])
+	}
+
+	if contentType == "application/octet-stream" {
+		if byExtension := mime.TypeByExtension(strings.ToLower(filepath.Ext(filePath))); byExtension != "" {
+			contentType = byExtension
+		}
+	}
+
+	// Drop parameters such as "; charset=utf-8"
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return strings.TrimSpace(mediaType)
+}
+
+// fitsPhotoLimits reports whether Telegram accepts the image as a photo. Dimensions are checked
+// for formats the standard library decodes, other images are checked by size only.
+func fitsPhotoLimits(filePath string, fileSize int64) bool {
+	if fileSize > core.PhotoMaxSizeMB*1024*1024 {
+		return false
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return true
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil || config.Width == 0 || config.Height == 0 {
+		return true
+	}
+
+	longSide, shortSide := max(config.Width, config.Height), min(config.Width, config.Height)
+	return config.Width+config.Height <= core.PhotoMaxDimensionsSum && longSide <= shortSide*core.PhotoMaxAspectRatio
+}
+
+// convertMetadata converts the yt-dlp infos of a link, one per media item. The estimated size is the one
+// of the formats yt-dlp selected for the configured quality, summed over the items.
+func (r *VideoDownloadRepository) convertMetadata(infos []*ytdlp.ExtractedInfo) *entity.VideoMetadata {
+	metadata := r.convertItemMetadata(infos[0])
+	if len(infos) == 1 {
+		return metadata
+	}
+
+	// Formats of one item don't apply to the others, so they are left for yt-dlp to pick
+	metadata.ItemCount = len(infos)
+	metadata.Formats = nil
+	for _, info := range infos[1:] {
+		item := r.convertItemMetadata(info)
+		metadata.EstimatedSize += item.EstimatedSize
+		metadata.Duration = max(metadata.Duration, item.Duration)
+		metadata.IsLive = metadata.IsLive || item.IsLive
+	}
+
+	return metadata
+}
+
+// convertItemMetadata converts the yt-dlp info of a single media item
+func (r *VideoDownloadRepository) convertItemMetadata(info *ytdlp.ExtractedInfo) *entity.VideoMetadata {
+	metadata := &entity.VideoMetadata{
+		ItemCount: 1,
+		Formats:   make([]entity.VideoFormat, 0, len(info.Formats)),
+	}
+
+	if info.Title != nil {
+		metadata.Title = *info.Title
+	}
+	if info.Duration != nil {
+		metadata.Duration = *info.Duration
+	}
+	if info.IsLive != nil {
+		metadata.IsLive = *info.IsLive
+	}
+
+	if len(info.RequestedFormats) > 0 {
+		for _, format := range info.RequestedFormats {
+			metadata.EstimatedSize += formatSize(format)
+		}
+	} else if info.ExtractedFormat != nil {
+		metadata.EstimatedSize = formatSize(info.ExtractedFormat)
+	}
+
+	for _, format := range info.Formats {
+		if format == nil || format.FormatID == nil {
 			continue
 		}
-		if latestFile == nil || info.ModTime().After(latestFile.ModTime()) {
-			latestFile = info
-			latestPath = filepath.Join(outputDir, entry.Name())
+
+		videoFormat := entity.VideoFormat{
+			ID:       *format.FormatID,
+			FileSize: formatSize(format),
+			// Codecs are "none" for a missing stream, unknown codecs are assumed to be present
+			HasVideo: format.VCodec == nil || *format.VCodec != "none",
+			HasAudio: format.ACodec == nil || *format.ACodec != "none",
+		}
+		if format.Height != nil {
+			videoFormat.Height = int(*format.Height)
 		}
+
+		metadata.Formats = append(metadata.Formats, videoFormat)
 	}
 
-	if latestPath != "" {
-		downloadedFile = latestPath
-		fileSize = latestFile.Size()
+	return metadata
+}
+
+// formatSize returns the exact size of a format, or the approximate one, 0 if neither is known
+func formatSize(format *ytdlp.ExtractedFormat) int64 {
+	if format.FileSize != nil {
+		return int64(*format.FileSize)
+	}
+	if format.FileSizeApprox != nil {
+		return int64(*format.FileSizeApprox)
 	}
+	return 0
+}
 
-	if downloadedFile == "" {
-		return &entity.VideoProcessResult{
-			Success: false,
-			Error:   fmt.Errorf("no file was downloaded"),
-		}, fmt.Errorf("download result empty")
+// convertProgress converts a yt-dlp progress update, the speed is averaged over the whole download
+func (r *VideoDownloadRepository) convertProgress(update ytdlp.ProgressUpdate) entity.DownloadProgress {
+	progress := entity.DownloadProgress{
+		Percent:         update.Percent(),
+		DownloadedBytes: int64(update.DownloadedBytes),
+		TotalBytes:      int64(update.TotalBytes),
 	}
 
-	// Check file size limit
-	maxSizeMB := int64(r.environment.VideoDownloaderConfiguration.MaxFileSizeMB)
-	if fileSize > maxSizeMB*1024*1024 {
-		// Clean up oversized file
-		os.Remove(downloadedFile)
-		return &entity.VideoProcessResult{
-			Success: false,
-			Error:   fmt.Errorf("file size %d MB exceeds limit of %d MB", fileSize/(1024*1024), maxSizeMB),
-		}, fmt.Errorf("file too large")
+	if elapsed := update.Duration().Seconds(); elapsed > 0 {
+		progress.Speed = float64(update.DownloadedBytes) / elapsed
 	}
 
-	return &entity.VideoProcessResult{
-		Success:  true,
-		FilePath: downloadedFile,
-		FileName: filepath.Base(downloadedFile),
-		FileSize: fileSize,
-	}, nil
+	return progress
+}
+
+// classifyDownloadError decides whether a yt-dlp failure is worth retrying.
+// Unknown errors are treated as transient, the retry limit bounds them anyway.
+func (r *VideoDownloadRepository) classifyDownloadError(err error) entity.FailureKind {
+	if _, ok := ytdlp.IsMisconfigError(err); ok {
+		return entity.FailureKindPermanent
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, marker := range core.PermanentDownloadErrorMarkers {
+		if strings.Contains(message, marker) {
+			return entity.FailureKindPermanent
+		}
+	}
+
+	return entity.FailureKindTransient
 }
 
 // applyYtdlpOptions applies yt-dlp configuration options from the environment
@@ -188,4 +571,4 @@ func (r *VideoDownloadRepository) applyYtdlpOptions(dl *ytdlp.Command) *ytdlp.Co
 	}
 
 	return dl
-}
+}
\ No newline at end of file
@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"tg-downloader/env"
+	"tg-downloader/src/features/video/domain/entity"
+)
+
+// fakeFfmpeg writes an executable standing in for ffmpeg, it copies the input to the output
+// and logs its arguments to the returned file
+func fakeFfmpeg(t *testing.T) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	executable := filepath.Join(dir, "ffmpeg")
+	callLog := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$@\" >> " + callLog + "\nfor output; do :; done\ncp \"$3\" \"$output\"\n"
+	if err := os.WriteFile(executable, []byte(script), 0o755); err != nil {
+		t.Fatalf("failed to write fake ffmpeg: %v", err)
+	}
+	return executable, callLog
+}
+
+func writeMediaFile(t *testing.T, dir string, name string, content []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+func TestRecodeVideosKeepsOtherMedia(t *testing.T) {
+	var photo bytes.Buffer
+	if err := png.Encode(&photo, image.NewRGBA(image.Rect(0, 0, 16, 16))); err != nil {
+		t.Fatalf("failed to encode photo: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		file     string
+		content  []byte
+		wantType entity.MediaType
+		wantFile string
+	}{
+		{"image", "post_1.png", photo.Bytes(), entity.MediaTypePhoto, "post_1.png"},
+		{"video in another format", "post_2.webm", []byte("\x1a\x45\xdf\xa3webm video"), entity.MediaTypeVideo, "post_2.mp4"},
+		{"video in output format", "post_3.mp4", []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), entity.MediaTypeVideo, "post_3.mp4"},
+		{"audio", "post_4.mp3", []byte("ID3\x03\x00\x00\x00\x00\x00\x00audio"), entity.MediaTypeAudio, "post_4.mp3"},
+	}
+
+	executable, callLog := fakeFfmpeg(t)
+	environment := env.TGDownloader{}
+	environment.CompressionConfiguration.FfmpegExecutablePath = executable
+	repo := &VideoDownloadRepository{environment: environment}
+
+	dir := t.TempDir()
+	items := make([]entity.MediaItem, 0, len(tests))
+	for _, test := range tests {
+		path := writeMediaFile(t, dir, test.file, test.content)
+		items = append(items, entity.MediaItem{
+			Type:     mediaType(path, int64(len(test.content))),
+			FilePath: path,
+			FileSize: int64(len(test.content)),
+		})
+	}
+
+	if err := repo.recodeVideos(context.Background(), items, "mp4"); err != nil {
+		t.Fatalf("expected the recode to succeed, got %v", err)
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			item := items[i]
+			if item.Type != test.wantType {
+				t.Fatalf("expected type %s, got %s", test.wantType, item.Type)
+			}
+			if name := filepath.Base(item.FilePath); name != test.wantFile {
+				t.Fatalf("expected file %s, got %s", test.wantFile, name)
+			}
+			content, err := os.ReadFile(item.FilePath)
+			if err != nil {
+				t.Fatalf("expected the file to exist: %v", err)
+			}
+			if !bytes.Equal(content, test.content) || item.FileSize != int64(len(content)) {
+				t.Fatalf("expected the contents of %s to be kept", test.file)
+			}
+		})
+	}
+
+	calls, err := os.ReadFile(callLog)
+	if err != nil {
+		t.Fatalf("expected ffmpeg to be run: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(calls)), "\n"); len(lines) != 1 || !strings.Contains(lines[0], "post_2.webm") {
+		t.Fatalf("expected ffmpeg to recode only post_2.webm, got %q", calls)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "post_2.webm")); !os.IsNotExist(err) {
+		t.Fatalf("expected the original of the recoded video to be removed")
+	}
+}
\ No newline at end of file
@@ -0,0 +1,26 @@
+package entity
+
+import (
+	botEntity "tg-downloader/src/features/bot/domain/entity"
+	"time"
+)
+
+// UploadedMedia identifies a file stored by Telegram, it can be sent again without uploading the bytes
+type UploadedMedia struct {
+	FileID       string // valid for this bot only
+	FileUniqueID string // same for every bot, can't be used to send the file
+}
+
+// CachedMedia is a video or an audio uploaded for a link before, requests of the same link in the same
+// mode are answered with it
+type CachedMedia struct {
+	Link         string // canonical form of the link
+	Mode         botEntity.TaskMode
+	FileID       string
+	FileUniqueID string
+	FileSize     int64
+	Duration     float64 // media duration in seconds, 0 if unknown
+	Title        string  // caption values of the media, empty if unknown
+	Uploader     string
+	CreatedAt    time.Time
+}
@@ -0,0 +1,11 @@
+package entity
+
+// CaptionValues are the values of the caption template placeholders, lines with only empty values are left out
+type CaptionValues struct {
+	Title     string
+	Uploader  string
+	Platform  string  // supported link name
+	Link      string  // link as it was posted
+	Duration  float64 // seconds, 0 if unknown
+	Requester string  // username of the user who posted the link
+}
\ No newline at end of file
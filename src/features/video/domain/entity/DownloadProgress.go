@@ -0,0 +1,12 @@
+package entity
+
+// DownloadProgress is a snapshot of a running download reported by yt-dlp
+type DownloadProgress struct {
+	Percent         float64 // 0-100, 0 when the total size is unknown
+	DownloadedBytes int64
+	TotalBytes      int64   // 0 when unknown
+	Speed           float64 // average speed in bytes per second
+}
+
+// DownloadProgressFunc receives progress updates of a download
+type DownloadProgressFunc func(progress DownloadProgress)
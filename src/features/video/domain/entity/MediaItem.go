@@ -0,0 +1,33 @@
+package entity
+
+// MediaType is the kind of a downloaded file, it decides how the file is sent to Telegram
+type MediaType string
+
+const (
+	MediaTypeVideo     MediaType = "video"
+	MediaTypePhoto     MediaType = "photo"
+	MediaTypeAnimation MediaType = "animation"
+	MediaTypeAudio     MediaType = "audio"
+	MediaTypeDocument  MediaType = "document" // images over the limits of Telegram photos, sent as files
+)
+
+// MediaItem is a single file of a link. A carousel or a post with several videos has one item per file,
+// a video cut into parts has one item per part.
+type MediaItem struct {
+	Type     MediaType
+	FilePath string
+	FileSize int64
+	Duration float64 // seconds, 0 for photos or if unknown
+	Caption  string
+	FileID   string // set by the first upload, other groups receive the same file
+
+	// Dimensions of a video, 0 if unknown. Without them Telegram may show the video with a wrong aspect ratio
+	Width  int
+	Height int
+
+	// Tags of an audio, shown by Telegram in the player
+	Title     string
+	Performer string
+
+	ThumbnailPath string // JPEG thumbnail of a video or cover of an audio, empty if there is none
+}
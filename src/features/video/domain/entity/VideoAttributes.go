@@ -0,0 +1,8 @@
+package entity
+
+// VideoAttributes are the properties of a video file Telegram shows before the video is played
+type VideoAttributes struct {
+	Width    int // as displayed, rotation is applied
+	Height   int
+	Duration float64 // seconds, 0 if unknown
+}
\ No newline at end of file
@@ -1,5 +1,7 @@
 package entity
 
+import "time"
+
 // VideoEvents is the channel for getting video processing events
 type VideoEvents <-chan VideoEvent
 
@@ -8,6 +10,49 @@ type VideoEvent interface {
 	isVideoEvent()
 }
 
+// VideoQueuePositionChanged event for a queued video whose position in the queue changed
+type VideoQueuePositionChanged struct {
+	GroupID   int64
+	MessageID int
+	Position  int           // 1-based position in the queue
+	ETA       time.Duration // estimated wait until the video is ready, 0 if unknown
+}
+
+func (VideoQueuePositionChanged) isVideoEvent() {}
+
+// VideoDownloadStarted event for a queued video that was taken by a worker
+type VideoDownloadStarted struct {
+	GroupID   int64
+	MessageID int
+}
+
+func (VideoDownloadStarted) isVideoEvent() {}
+
+// VideoDownloadProgress event for a running download, emitted at most once per progress update interval
+type VideoDownloadProgress struct {
+	GroupID   int64
+	MessageID int
+	Progress  DownloadProgress
+}
+
+func (VideoDownloadProgress) isVideoEvent() {}
+
+// VideoCompressionStarted event for a downloaded video being re-encoded to fit the upload limit
+type VideoCompressionStarted struct {
+	GroupID   int64
+	MessageID int
+}
+
+func (VideoCompressionStarted) isVideoEvent() {}
+
+// VideoProcessResumed event for a task that was abandoned by a crashed or restarted worker and queued again
+type VideoProcessResumed struct {
+	GroupID   int64
+	MessageID int
+}
+
+func (VideoProcessResumed) isVideoEvent() {}
+
 // VideoUploadStarted event for when video upload to Telegram starts
 type VideoUploadStarted struct {
 	GroupID   int64
@@ -29,6 +74,7 @@ type VideoProcessFailure struct {
 	GroupID      int64
 	MessageID    int
 	ErrorMessage string
+	HistoryID    int // task history entry the download can be retried from, 0 if it can't
 }
 
 func (VideoProcessFailure) isVideoEvent() {}
\ No newline at end of file
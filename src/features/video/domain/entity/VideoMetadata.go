@@ -0,0 +1,20 @@
+package entity
+
+// VideoMetadata describes a media link as reported by yt-dlp before anything is downloaded
+type VideoMetadata struct {
+	Title         string
+	Duration      float64 // seconds of the longest item, 0 if unknown
+	IsLive        bool
+	EstimatedSize int64         // bytes of the format selected by the configured quality, 0 if unknown
+	ItemCount     int           // number of media items, more than 1 for carousels and posts with several videos
+	Formats       []VideoFormat // formats of a single item, empty when there are several
+}
+
+// VideoFormat is a single format available for download, formats are ordered from worst to best quality
+type VideoFormat struct {
+	ID       string
+	Height   int
+	FileSize int64 // exact or approximate size in bytes, 0 if unknown
+	HasVideo bool
+	HasAudio bool
+}
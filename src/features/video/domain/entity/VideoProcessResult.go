@@ -1,11 +1,70 @@
 package entity
 
+import "errors"
+
+// ErrCompressionInsufficient is returned when a video can't be re-encoded small enough in acceptable quality
+var ErrCompressionInsufficient = errors.New("video can't be compressed to fit the size limit")
+
+// ErrChatUnavailable is returned by uploads to a chat the bot can't post to at all, e.g. it was removed from the group
+var ErrChatUnavailable = errors.New("chat is unavailable to the bot")
+
+// FailureKind tells whether a failed video processing attempt is worth retrying
+type FailureKind string
+
+const (
+	// FailureKindTransient is used for failures that may go away on their own (rate limits, timeouts, extractor hiccups)
+	FailureKindTransient FailureKind = "transient"
+	// FailureKindPermanent is used for failures that will repeat on every attempt (unsupported URL, file too large)
+	FailureKindPermanent FailureKind = "permanent"
+)
+
 // VideoProcessResult represents the result of a video processing operation
 type VideoProcessResult struct {
-	Success   bool
-	FilePath  string
-	Error     error
-	GroupID   int64
-	FileName  string
-	FileSize  int64
+	Success       bool
+	FilePath      string
+	Error         error
+	FailureKind   FailureKind
+	GroupID       int64
+	FileName      string
+	FileSize      int64
+	Duration      float64            // media duration in seconds, 0 if unknown
+	Width         int                // width of a single video, 0 if unknown
+	Height        int                // height of a single video, 0 if unknown
+	ThumbnailPath string             // path of the JPEG thumbnail of a single video, empty if there is none
+	Title         string             // title of the link reported by yt-dlp, empty if unknown
+	Uploader      string             // author of the link reported by yt-dlp, empty if unknown
+	Compression   *CompressionResult // nil when the file is uploaded as downloaded
+	Uploaded      *UploadedMedia     // set by the first upload of FilePath, other groups receive the same file
+	// Items are the downloaded files in the order of the post. A single video is described by FilePath too
+	// and is uploaded from it, otherwise the items are sent as media groups: the files of a multi-item
+	// post or the parts of a video cut to fit the upload limit.
+	Items []MediaItem
+}
+
+// IsSingleVideo reports whether the result is one video uploaded from FilePath
+func (r *VideoProcessResult) IsSingleVideo() bool {
+	return len(r.Items) == 1 && r.Items[0].Type == MediaTypeVideo
+}
+
+// IsSingleAudio reports whether the result is one audio extracted in the audio mode
+func (r *VideoProcessResult) IsSingleAudio() bool {
+	return len(r.Items) == 1 && r.Items[0].Type == MediaTypeAudio
+}
+
+// VideoPart is a piece of a video which was cut to fit the upload limit
+type VideoPart struct {
+	FilePath string
+	FileSize int64
+	Number   int // 1-based
+	Total    int
+}
+
+// CompressionResult describes a video re-encoded to fit the upload limit
+type CompressionResult struct {
+	FilePath         string
+	FileSize         int64
+	OriginalSize     int64
+	VideoBitrateKbps int
+	Height           int // maximum height the video was scaled down to
+	Attempts         int // number of encodes it took to fit
 }
\ No newline at end of file
@@ -0,0 +1,17 @@
+package repository
+
+import (
+	"context"
+	botEntity "tg-downloader/src/features/bot/domain/entity"
+	"tg-downloader/src/features/video/domain/entity"
+)
+
+// IMediaCacheRepository stores the files uploaded for links. Links are looked up by their
+// canonical form, so the same media shared with tracking parameters or another host alias is found too.
+type IMediaCacheRepository interface {
+	// FindMedia returns the media uploaded for the link in the mode, or nil when there is none
+	FindMedia(ctx context.Context, link string, mode botEntity.TaskMode) (*entity.CachedMedia, error)
+	// SaveMedia stores the media uploaded for the link in media.Mode, replacing the previous one
+	SaveMedia(ctx context.Context, link string, media entity.CachedMedia) error
+	DeleteMedia(ctx context.Context, link string, mode botEntity.TaskMode) error
+}
@@ -1,5 +1,19 @@
 package repository
 
+import (
+	"context"
+	"tg-downloader/src/features/video/domain/entity"
+)
+
 type IUploadRepository interface {
-	UploadVideo(filePath string, groupID int64) error
+	// UploadVideo uploads the video of the result with its dimensions, duration and thumbnail
+	// and the caption, and returns the file Telegram stored it as
+	UploadVideo(ctx context.Context, video *entity.VideoProcessResult, caption string, groupID int64) (*entity.UploadedMedia, error)
+	// SendVideo sends a video uploaded before by its file_id
+	SendVideo(ctx context.Context, fileID string, caption string, groupID int64) error
+	// SendAudio sends an audio uploaded before by its file_id
+	SendAudio(ctx context.Context, fileID string, caption string, groupID int64) error
+	// UploadMedia sends the items as media groups keeping their order and returns the files
+	// Telegram stored them as, in the order of the items. Captions are formatted in the configured parse mode
+	UploadMedia(ctx context.Context, items []entity.MediaItem, groupID int64) ([]entity.UploadedMedia, error)
 }
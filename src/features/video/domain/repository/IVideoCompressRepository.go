@@ -0,0 +1,15 @@
+package repository
+
+import (
+	"context"
+	"tg-downloader/src/features/video/domain/entity"
+)
+
+type IVideoCompressRepository interface {
+	CompressVideo(ctx context.Context, filePath string, duration float64, maxSize int64) (*entity.CompressionResult, error)
+	SplitVideo(ctx context.Context, filePath string, duration float64, maxSize int64, maxParts int) ([]entity.VideoPart, error)
+	// InspectVideo reads the dimensions and the duration of the video file
+	InspectVideo(ctx context.Context, filePath string) (*entity.VideoAttributes, error)
+	// ExtractThumbnail saves a frame of the video as a JPEG thumbnail of the size Telegram accepts
+	ExtractThumbnail(ctx context.Context, filePath string, duration float64, thumbnailPath string) error
+}
\ No newline at end of file
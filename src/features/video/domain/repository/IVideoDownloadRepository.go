@@ -1,8 +1,14 @@
 package repository
 
-import "tg-downloader/src/features/video/domain/entity"
+import (
+	"context"
+	"tg-downloader/src/features/video/domain/entity"
+)
 
 type IVideoDownloadRepository interface {
 	ValidateURL(url string) (bool, string, error)
-	DownloadVideo(url string, outputDir string) (*entity.VideoProcessResult, error)
+	ProbeVideo(ctx context.Context, url string) (*entity.VideoMetadata, error)
+	DownloadVideo(ctx context.Context, url string, outputDir string, format string, onProgress entity.DownloadProgressFunc) (*entity.VideoProcessResult, error)
+	// DownloadAudio extracts only the audio track of the link, the result has a single audio item
+	DownloadAudio(ctx context.Context, url string, outputDir string, onProgress entity.DownloadProgressFunc) (*entity.VideoProcessResult, error)
 }
\ No newline at end of file
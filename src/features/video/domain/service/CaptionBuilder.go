@@ -0,0 +1,197 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"tg-downloader/env"
+	"tg-downloader/env/captionparsemode"
+	"tg-downloader/src/core"
+	"tg-downloader/src/features/video/domain/entity"
+	"unicode/utf16"
+)
+
+// captionPlaceholder matches the placeholders of the caption template
+var captionPlaceholder = regexp.MustCompile(`\{(title|uploader|platform|link|duration|requester)\}`)
+
+// shortenedPlaceholders are the placeholders whose values may be cut to fit the caption limit,
+// links and platform names are not cut as they would break
+var shortenedPlaceholders = []string{"title", "uploader", "requester"}
+
+var htmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+var markdownV2Escaper = strings.NewReplacer(
+	"\\", "\\\\", "_", "\\_", "*", "\\*", "[", "\\[", "]", "\\]", "(", "\\(", ")", "\\)", "~", "\\~",
+	"`", "\\`", ">", "\\>", "#", "\\#", "+", "\\+", "-", "\\-", "=", "\\=", "|", "\\|", "{", "\\{",
+	"}", "\\}", ".", "\\.", "!", "\\!",
+)
+
+// markdownV2URLEscaper escapes the URL of a MarkdownV2 inline link, where only these characters are special
+var markdownV2URLEscaper = strings.NewReplacer("\\", "\\\\", ")", "\\)")
+
+// CaptionBuilder renders captions of uploaded media from the configured template
+type CaptionBuilder struct {
+	config env.CaptionConfiguration
+}
+
+// NewCaptionBuilder creates a builder of captions in the configured parse mode.
+func NewCaptionBuilder(config env.CaptionConfiguration) *CaptionBuilder {
+	return &CaptionBuilder{
+		config: config,
+	}
+}
+
+// Build renders the caption for the values followed by the plain text suffix, e.g. the part number of a
+// split video. Values are escaped for the parse mode and the longest ones are shortened until the caption
+// fits the Telegram limit. When it can't fit, only the suffix is returned, so the markup is never cut.
+func (b *CaptionBuilder) Build(values entity.CaptionValues, suffix string) string {
+	suffix = b.Escape(suffix)
+	if !b.config.Enabled {
+		return suffix
+	}
+
+	limit := core.CaptionMaxLength
+	if suffix != "" {
+		limit -= captionLength(suffix + core.CaptionPartSeparator)
+	}
+
+	fields := map[string]string{
+		"title":     strings.TrimSpace(values.Title),
+		"uploader":  strings.TrimSpace(values.Uploader),
+		"platform":  values.Platform,
+		"link":      values.Link,
+		"duration":  formatDuration(values.Duration),
+		"requester": values.Requester,
+	}
+
+	caption := b.render(fields)
+	for captionLength(caption) > limit {
+		longest := ""
+		for _, name := range shortenedPlaceholders {
+			if len([]rune(fields[name])) > len([]rune(fields[longest])) {
+				longest = name
+			}
+		}
+		if longest == "" {
+			return suffix
+		}
+
+		fields[longest] = b.shorten(fields[longest], captionLength(caption)-limit)
+		caption = b.render(fields)
+	}
+
+	if caption == "" {
+		return suffix
+	}
+	if suffix == "" {
+		return caption
+	}
+	return caption + core.CaptionPartSeparator + suffix
+}
+
+// render fills the placeholders of the template with the escaped values. Lines whose placeholders
+// are all empty are left out, so missing metadata doesn't leave bare labels behind.
+func (b *CaptionBuilder) render(fields map[string]string) string {
+	lines := strings.Split(b.config.Template, "\n")
+	rendered := make([]string, 0, len(lines))
+
+	for _, line := range lines {
+		placeholders := captionPlaceholder.FindAllStringSubmatch(line, -1)
+		if len(placeholders) > 0 {
+			hasValue := false
+			for _, placeholder := range placeholders {
+				if fields[placeholder[1]] != "" {
+					hasValue = true
+					break
+				}
+			}
+			if !hasValue {
+				continue
+			}
+		}
+
+		rendered = append(rendered, b.renderLine(line, fields))
+	}
+
+	return strings.TrimSpace(strings.Join(rendered, "\n"))
+}
+
+// renderLine fills the placeholders of a template line with the values escaped for their place
+func (b *CaptionBuilder) renderLine(line string, fields map[string]string) string {
+	var builder strings.Builder
+	end := 0
+
+	for _, match := range captionPlaceholder.FindAllStringSubmatchIndex(line, -1) {
+		builder.WriteString(line[end:match[0]])
+		value := fields[line[match[2]:match[3]]]
+		if b.inLinkURL(line[:match[0]]) {
+			builder.WriteString(markdownV2URLEscaper.Replace(value))
+		} else {
+			builder.WriteString(b.Escape(value))
+		}
+		end = match[1]
+	}
+	builder.WriteString(line[end:])
+
+	return builder.String()
+}
+
+// inLinkURL reports whether the template text following the given one is inside the URL of a MarkdownV2
+// inline link, e.g. {link} in [source]({link}). Escaping it as text would break the link.
+func (b *CaptionBuilder) inLinkURL(before string) bool {
+	if b.config.ParseMode != captionparsemode.MarkdownV2 {
+		return false
+	}
+
+	start := strings.LastIndex(before, "](")
+	return start >= 0 && !strings.Contains(before[start+2:], ")")
+}
+
+// Escape makes the plain text appear as is in the configured parse mode
+func (b *CaptionBuilder) Escape(text string) string {
+	switch b.config.ParseMode {
+	case captionparsemode.HTML:
+		return htmlEscaper.Replace(text)
+	case captionparsemode.MarkdownV2:
+		return markdownV2Escaper.Replace(text)
+	default:
+		return text
+	}
+}
+
+// shorten cuts the end of the value off, so its escaped form gets at least excess characters shorter,
+// and marks the cut with an ellipsis
+func (b *CaptionBuilder) shorten(value string, excess int) string {
+	runes := []rune(value)
+	keep, removed := len(runes), 0
+	// One more character makes room for the ellipsis
+	for keep > 0 && removed <= excess {
+		keep--
+		removed += captionLength(b.Escape(string(runes[keep])))
+	}
+	if keep == 0 {
+		return ""
+	}
+	return strings.TrimSpace(string(runes[:keep])) + "…"
+}
+
+// captionLength counts the text the way Telegram limits it, in UTF-16 code units
+func captionLength(text string) int {
+	length := 0
+	for _, r := range text {
+		length += utf16.RuneLen(r)
+	}
+	return length
+}
+
+// formatDuration formats seconds as m:ss or h:mm:ss, 0 gives an empty value
+func formatDuration(seconds float64) string {
+	total := int(seconds + 0.5)
+	if total <= 0 {
+		return ""
+	}
+	if total >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", total/3600, total%3600/60, total%60)
+	}
+	return fmt.Sprintf("%d:%02d", total/60, total%60)
+}
\ No newline at end of file
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"tg-downloader/env"
+	"tg-downloader/env/captionparsemode"
+	"tg-downloader/src/core"
+	"tg-downloader/src/features/video/domain/entity"
+	"unicode/utf8"
+)
+
+func TestCaptionBuilderEscapes(t *testing.T) {
+	tests := []struct {
+		name      string
+		parseMode captionparsemode.CaptionParseMode
+		template  string
+		values    entity.CaptionValues
+		suffix    string
+		want      string
+	}{
+		{
+			name:      "HTML text",
+			parseMode: captionparsemode.HTML,
+			template:  "<b>{title}</b>\nby {uploader}",
+			values:    entity.CaptionValues{Title: `Tom & Jerry <3 "live"`},
+			want:      "<b>Tom &amp; Jerry &lt;3 &quot;live&quot;</b>",
+		},
+		{
+			name:      "HTML link and suffix",
+			parseMode: captionparsemode.HTML,
+			template:  `<a href="{link}">{platform}</a>`,
+			values:    entity.CaptionValues{Platform: "YouTube", Link: "https://youtube.com/watch?v=1&t=2"},
+			suffix:    "Part 1/2 <end>",
+			want:      `<a href="https://youtube.com/watch?v=1&amp;t=2">YouTube</a>` + "\n\nPart 1/2 &lt;end&gt;",
+		},
+		{
+			name:      "MarkdownV2 text",
+			parseMode: captionparsemode.MarkdownV2,
+			template:  "*{title}*\n{duration}",
+			values:    entity.CaptionValues{Title: "a_b*c [d](e) ~1.5!", Duration: 75},
+			want:      "*a\\_b\\*c \\[d\\]\\(e\\) \\~1\\.5\\!*\n1:15",
+		},
+		{
+			name:      "MarkdownV2 link with parenthesis",
+			parseMode: captionparsemode.MarkdownV2,
+			template:  "{title} [src]({link})",
+			values:    entity.CaptionValues{Title: "Go (game)", Link: `https://en.wikipedia.org/wiki/Go_(game)\x`},
+			want:      `Go \(game\) [src](https://en.wikipedia.org/wiki/Go_(game\)\\x)`,
+		},
+		{
+			name:      "MarkdownV2 suffix",
+			parseMode: captionparsemode.MarkdownV2,
+			template:  "{title}",
+			suffix:    "Part 1/2.",
+			want:      "Part 1/2\\.",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			builder := NewCaptionBuilder(env.CaptionConfiguration{
+				Enabled:   true,
+				ParseMode: test.parseMode,
+				Template:  test.template,
+			})
+
+			if caption := builder.Build(test.values, test.suffix); caption != test.want {
+				t.Fatalf("expected caption %q, got %q", test.want, caption)
+			}
+		})
+	}
+}
+
+func TestCaptionBuilderShortensToLimit(t *testing.T) {
+	const link = "https://example.com/watch?v=(1)"
+	// Emoji outside the BMP take two UTF-16 code units each, so the title is over the limit by itself
+	title := strings.Repeat("😀", 400) + " & " + strings.Repeat("🎬_", 200)
+
+	tests := []struct {
+		name      string
+		parseMode captionparsemode.CaptionParseMode
+		template  string
+		suffix    string
+	}{
+		{"HTML", captionparsemode.HTML, "<b>{title}</b>\n<a href=\"{link}\">source</a>", ""},
+		{"HTML with part", captionparsemode.HTML, "<b>{title}</b>\n<a href=\"{link}\">source</a>", "Part 2/3"},
+		{"MarkdownV2", captionparsemode.MarkdownV2, "*{title}*\n[source]({link})", ""},
+		{"MarkdownV2 with part", captionparsemode.MarkdownV2, "*{title}*\n[source]({link})", "Part 2/3"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			builder := NewCaptionBuilder(env.CaptionConfiguration{
+				Enabled:   true,
+				ParseMode: test.parseMode,
+				Template:  test.template,
+			})
+
+			caption := builder.Build(entity.CaptionValues{Title: title, Link: link}, test.suffix)
+
+			length := captionLength(caption)
+			if length > core.CaptionMaxLength {
+				t.Fatalf("expected the caption to fit %d UTF-16 code units, got %d", core.CaptionMaxLength, length)
+			}
+			// The title is cut by single characters, so hardly any room is left unused
+			if length < core.CaptionMaxLength-8 {
+				t.Fatalf("expected the title to be cut just enough, got %d UTF-16 code units", length)
+			}
+			if !utf8.ValidString(caption) || !strings.Contains(caption, "…") {
+				t.Fatalf("expected the title to be cut on a character and marked with an ellipsis, got %q", caption)
+			}
+
+			wantEnd := strings.TrimPrefix(test.template, "*{title}*")
+			wantEnd = strings.TrimPrefix(wantEnd, "<b>{title}</b>")
+			linkEscaper := htmlEscaper
+			if test.parseMode == captionparsemode.MarkdownV2 {
+				linkEscaper = markdownV2URLEscaper
+			}
+			wantEnd = strings.Replace(wantEnd, "{link}", linkEscaper.Replace(link), 1)
+			if test.suffix != "" {
+				wantEnd += core.CaptionPartSeparator + test.suffix
+			}
+			if !strings.HasSuffix(caption, wantEnd) {
+				t.Fatalf("expected the link and the part to be kept whole, got %q", caption[max(0, len(caption)-len(wantEnd)-10):])
+			}
+		})
+	}
+}
\ No newline at end of file
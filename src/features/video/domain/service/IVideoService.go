@@ -1,12 +1,17 @@
 package service
 
-import "tg-downloader/src/features/video/domain/entity"
+import (
+	botEntity "tg-downloader/src/features/bot/domain/entity"
+	"tg-downloader/src/features/video/domain/entity"
+)
 
 type VideoProcessCallback func(groupID int64, success bool, result string)
 
 type IVideoService interface {
 	StartWorkers()
 	StopWorkers()
-	ProcessVideo(link string, groupID int64, messageID int) error
+	ProcessVideo(link string, mode botEntity.TaskMode, groupID int64, messageID int, requester string, priority botEntity.TaskPriority) error
+	CancelVideo(groupID int64, messageID int, link string) (statusMessageID int, err error)
+	FindFailedTask(groupID int64, historyID int) (*botEntity.ArchivedTask, error)
 	GetVideoEvents() entity.VideoEvents
 }
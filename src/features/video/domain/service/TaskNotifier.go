@@ -0,0 +1,28 @@
+package service
+
+// TaskNotifier wakes idle workers as soon as a task may be available.
+// The database stays the source of truth, a notification only means "check the queue".
+type TaskNotifier struct {
+	signals chan struct{}
+}
+
+// NewTaskNotifier creates a notifier able to hold one pending wake-up per worker.
+func NewTaskNotifier(workerCount int) *TaskNotifier {
+	return &TaskNotifier{
+		signals: make(chan struct{}, workerCount),
+	}
+}
+
+// Notify wakes one idle worker. It never blocks: when enough wake-ups are
+// already pending, the extra one is dropped as nobody would miss it.
+func (n *TaskNotifier) Notify() {
+	select {
+	case n.signals <- struct{}{}:
+	default:
+	}
+}
+
+// Signals returns the channel idle workers wait on.
+func (n *TaskNotifier) Signals() <-chan struct{} {
+	return n.signals
+}
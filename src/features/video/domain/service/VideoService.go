@@ -2,33 +2,65 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"tg-downloader/env"
 	"tg-downloader/src/core"
 	"tg-downloader/src/core/logger"
+	botEntity "tg-downloader/src/features/bot/domain/entity"
 	botRepo "tg-downloader/src/features/bot/domain/repository"
 	"tg-downloader/src/features/video/domain/entity"
 	"tg-downloader/src/features/video/domain/repository"
 	"time"
 )
 
+// ErrNothingToCancel is returned by CancelVideo when the group has no matching queued or running task
+var ErrNothingToCancel = errors.New("nothing to cancel")
+
+// ErrNothingToRetry is returned by FindFailedTask when the failed task is not in the history of the group anymore
+var ErrNothingToRetry = errors.New("nothing to retry")
+
 type VideoTask struct {
 	ID               int
+	WorkerID         string // worker holding the task lease
 	Link             string
+	Mode             botEntity.TaskMode
 	GroupIDs         []int64
-	StatusMessageIDs map[int64]int // groupID -> messageID for status messages
+	StatusMessageIDs map[int64]int    // groupID -> messageID for status messages
+	Requesters       map[int64]string // groupID -> username of the user who posted the link
+	Attempts         int              // number of failed attempts before this one
+	Platform         string           // supported link name, known after URL validation
+}
+
+// queueEntry identifies the status message of one group waiting for a task
+type queueEntry struct {
+	taskID  int
+	groupID int64
 }
 
 type VideoService struct {
 	environment  env.TGDownloader
 	taskRepo     botRepo.ITaskRepository
 	downloadRepo repository.IVideoDownloadRepository
+	compressRepo repository.IVideoCompressRepository
 	uploadRepo   repository.IUploadRepository
-	taskQueue    chan VideoTask
-	stopChannel  chan struct{}
+	mediaCache   repository.IMediaCacheRepository
+	captions     *CaptionBuilder
+	notifier     *TaskNotifier
+	queueChanged *TaskNotifier // wakes the reporter of queue positions
+	instanceID   string
+	ctx          context.Context // cancelled on shutdown, stops workers and in-flight downloads
+	cancel       context.CancelFunc
 	eventChannel chan entity.VideoEvent
+	runningTasks map[int]context.CancelFunc // taskID -> cancel of the task processed by this instance
+	tasksMutex   sync.Mutex
+	queueShown   map[queueEntry]int // queue position last shown in the status message
+	queueMutex   sync.Mutex
 	wg           sync.WaitGroup
 	running      bool
 	mutex        sync.RWMutex
@@ -41,17 +73,29 @@ func NewVideoService(
 	environment env.TGDownloader,
 	taskRepo botRepo.ITaskRepository,
 	downloadRepo repository.IVideoDownloadRepository,
+	compressRepo repository.IVideoCompressRepository,
 	uploadRepo repository.IUploadRepository,
+	mediaCache repository.IMediaCacheRepository,
 	logger *logger.Logger,
 ) *VideoService {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &VideoService{
 		environment:  environment,
 		taskRepo:     taskRepo,
 		downloadRepo: downloadRepo,
+		compressRepo: compressRepo,
 		uploadRepo:   uploadRepo,
-		taskQueue:    make(chan VideoTask, environment.WorkerConfiguration.WorkerCount),
-		stopChannel:  make(chan struct{}),
+		mediaCache:   mediaCache,
+		captions:     NewCaptionBuilder(environment.CaptionConfiguration),
+		notifier:     NewTaskNotifier(environment.WorkerConfiguration.WorkerCount),
+		queueChanged: NewTaskNotifier(1),
+		instanceID:   newInstanceID(),
+		ctx:          ctx,
+		cancel:       cancel,
 		eventChannel: make(chan entity.VideoEvent, 100),
+		runningTasks: make(map[int]context.CancelFunc),
+		queueShown:   make(map[queueEntry]int),
 		running:      false,
 		logger:       logger,
 	}
@@ -70,12 +114,26 @@ func (s *VideoService) StartWorkers() {
 	// Start worker pool
 	for i := 0; i < s.environment.WorkerConfiguration.WorkerCount; i++ {
 		s.wg.Add(1)
-		go s.worker()
+		go s.worker(fmt.Sprintf("%s/%d", s.instanceID, i))
 	}
 
-	// Start task scheduler
+	// Start task scheduler and pick up tasks left from the previous run
 	s.wg.Add(1)
 	go s.taskScheduler()
+	s.notifier.Notify()
+
+	// Start reclaimer for tasks abandoned by a crash or restart
+	s.wg.Add(1)
+	go s.staleTaskReclaimer()
+
+	// Start pruner of old task history
+	s.wg.Add(1)
+	go s.historyPruner()
+
+	// Start reporter of queue positions to the waiting groups
+	s.wg.Add(1)
+	go s.queueReporter()
+	s.queueChanged.Notify()
 
 	s.logger.Debug(fmt.Sprintf("VideoService started with %d workers", s.environment.WorkerConfiguration.WorkerCount))
 }
@@ -89,15 +147,167 @@ func (s *VideoService) StopWorkers() {
 	}
 
 	s.running = false
-	close(s.stopChannel)
+	// Cancelling the context kills running yt-dlp processes, their tasks are put back to the queue
+	s.cancel()
 	s.wg.Wait()
 
 	s.logger.Debug("VideoService stopped")
 }
 
-func (s *VideoService) ProcessVideo(link string, groupID int64, messageID int) error {
-	_, err := s.taskRepo.CreateTask(link, groupID, messageID)
-	return err
+func (s *VideoService) ProcessVideo(link string, mode botEntity.TaskMode, groupID int64, messageID int, requester string, priority botEntity.TaskPriority) error {
+	media, err := s.mediaCache.FindMedia(s.ctx, link, mode)
+	if err != nil {
+		s.logger.Warn(fmt.Sprintf("Failed to look up cached media for %s: %v", link, err))
+	}
+
+	// A link uploaded before is sent in the background like the tasks are processed,
+	// the request is only recorded here
+	if media != nil && s.startBackgroundWork() {
+		go func() {
+			defer s.wg.Done()
+			if s.sendCachedMedia(media, link, mode, groupID, messageID, requester) {
+				return
+			}
+			if err := s.createTask(link, mode, groupID, messageID, requester, priority); err != nil {
+				s.logger.Error(fmt.Sprintf("Failed to create task for %s: %v", link, err))
+			}
+		}()
+		return nil
+	}
+
+	return s.createTask(link, mode, groupID, messageID, requester, priority)
+}
+
+// createTask queues the link for the workers. A request arriving during shutdown is still queued,
+// it is processed after restart.
+func (s *VideoService) createTask(link string, mode botEntity.TaskMode, groupID int64, messageID int, requester string, priority botEntity.TaskPriority) error {
+	_, err := s.taskRepo.CreateTask(context.WithoutCancel(s.ctx), link, mode, groupID, messageID, requester, priority)
+	if err != nil {
+		return err
+	}
+
+	s.notifier.Notify()
+	s.queueChanged.Notify()
+	return nil
+}
+
+// startBackgroundWork registers work waited for by StopWorkers, it returns false once the workers are stopped
+func (s *VideoService) startBackgroundWork() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.running {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+// sendCachedMedia answers a link uploaded before in the same mode with the stored file, without
+// downloading it again. Returns false when the link has to be downloaded.
+func (s *VideoService) sendCachedMedia(media *entity.CachedMedia, link string, mode botEntity.TaskMode, groupID int64, messageID int, requester string) bool {
+	// Like the uploads of tasks, the send is not interrupted by shutdown but bound by a timeout
+	uploadTimeout := time.Duration(s.environment.WorkerConfiguration.UploadTimeoutSeconds) * time.Second
+	uploadCtx, cancelUpload := context.WithTimeout(context.WithoutCancel(s.ctx), uploadTimeout)
+	defer cancelUpload()
+
+	send := s.uploadRepo.SendVideo
+	if mode == botEntity.TaskModeAudio {
+		send = s.uploadRepo.SendAudio
+	}
+
+	// The platform is not cached, it is the name of the supported link pattern
+	_, platform, _ := s.downloadRepo.ValidateURL(link)
+	caption := s.captions.Build(entity.CaptionValues{
+		Title:     media.Title,
+		Uploader:  media.Uploader,
+		Platform:  platform,
+		Link:      link,
+		Duration:  media.Duration,
+		Requester: requester,
+	}, "")
+
+	if err := send(uploadCtx, media.FileID, caption, groupID); err != nil {
+		// Downloading the link again would not help a group the bot can't post to
+		if errors.Is(err, entity.ErrChatUnavailable) {
+			s.logger.Warn(fmt.Sprintf("Failed to send cached media for %s, group %d is unavailable: %v", link, groupID, err))
+			return true
+		}
+		// The file_id is no longer accepted, e.g. the bot token changed, so the link is downloaded again
+		s.logger.Warn(fmt.Sprintf("Failed to send cached media for %s to group %d, downloading it again: %v", link, groupID, err))
+		if err := s.mediaCache.DeleteMedia(s.ctx, link, mode); err != nil {
+			s.logger.Warn(fmt.Sprintf("Failed to delete cached media for %s: %v", link, err))
+		}
+		return false
+	}
+
+	s.logger.Debug(fmt.Sprintf("Sent cached media for %s to group %d", link, groupID))
+	s.emit(entity.VideoProcessSuccess{GroupID: groupID, MessageID: messageID})
+	return true
+}
+
+// CancelVideo removes the group from the task it requested, found by the status message or by the link.
+// The task itself is aborted when no other group waits for it. Returns the status message of the group.
+func (s *VideoService) CancelVideo(groupID int64, messageID int, link string) (int, error) {
+	task := s.findTaskToCancel(groupID, messageID, link)
+	if task == nil {
+		return 0, ErrNothingToCancel
+	}
+
+	statusMessageID := task.StatusMessageIDs[groupID]
+
+	updatedTask, err := s.taskRepo.RemoveGroupFromTask(s.ctx, task.ID, groupID)
+	if err != nil {
+		return 0, err
+	}
+
+	s.logger.Debug(fmt.Sprintf("Removed group %d from task %d, remaining groups: %v", groupID, task.ID, updatedTask.GroupIDs))
+
+	s.queueChanged.Notify()
+
+	if updatedTask.Status == botEntity.TaskStatusCancelled {
+		s.logger.Info(fmt.Sprintf("Task %d cancelled: %s", task.ID, task.Link))
+		// A task running on another instance is aborted once its worker fails to renew the lease
+		s.cancelRunningTask(task.ID)
+	}
+
+	return statusMessageID, nil
+}
+
+// findTaskToCancel looks up the task of the group by its status message first, then by the link
+func (s *VideoService) findTaskToCancel(groupID int64, messageID int, link string) *botEntity.Task {
+	if messageID > 0 {
+		if task, err := s.taskRepo.FindTaskByStatusMessage(s.ctx, groupID, messageID); err == nil {
+			return task
+		}
+	}
+
+	if link != "" {
+		for _, mode := range []botEntity.TaskMode{botEntity.TaskModeVideo, botEntity.TaskModeAudio} {
+			task, err := s.taskRepo.FindTaskByLink(s.ctx, link, mode)
+			if err == nil && slices.Contains(task.GroupIDs, groupID) {
+				return task
+			}
+		}
+	}
+
+	return nil
+}
+
+// FindFailedTask returns the history entry of a task the group requested, so its link can be requested again
+func (s *VideoService) FindFailedTask(groupID int64, historyID int) (*botEntity.ArchivedTask, error) {
+	archivedTask, err := s.taskRepo.GetArchivedTask(s.ctx, historyID)
+	if err != nil {
+		// The entry may have been pruned from the history
+		s.logger.Debug(fmt.Sprintf("Task history entry %d not found: %v", historyID, err))
+		return nil, ErrNothingToRetry
+	}
+
+	if !slices.Contains(archivedTask.GroupIDs, groupID) {
+		return nil, ErrNothingToRetry
+	}
+
+	return archivedTask, nil
 }
 
 func (s *VideoService) GetVideoEvents() entity.VideoEvents {
@@ -112,189 +322,1086 @@ func (s *VideoService) taskScheduler() {
 
 	for {
 		select {
-		case <-s.stopChannel:
+		case <-s.ctx.Done():
 			return
 		case <-ticker.C:
-			// Wake up all idle workers to check for tasks
-			s.scheduleAvailableTasks()
+			// Safety net for tasks nobody was notified about, e.g. delayed retries
+			// that became due after a restart
+			s.notifier.Notify()
 		}
 	}
 }
 
-func (s *VideoService) scheduleAvailableTasks() {
-	s.logger.Debug("scheduleAvailableTasks called")
+func (s *VideoService) staleTaskReclaimer() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(s.environment.WorkerConfiguration.HeartbeatIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	// Tasks left behind by a previous run are reclaimed right away on startup
+	s.reclaimStaleTasks()
 
-	// Get all available tasks and queue them for workers
-	taskCount := 0
 	for {
-		s.logger.Debug(fmt.Sprintf("Attempting to get next task (iteration %d)", taskCount))
-		task, err := s.taskRepo.GetNextTask()
-		if err != nil {
-			// No more tasks available
-			s.logger.Debug(fmt.Sprintf("No more tasks available after %d tasks, error: %v", taskCount, err))
-			break
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.reclaimStaleTasks()
 		}
+	}
+}
+
+func (s *VideoService) reclaimStaleTasks() {
+	tasks, failedTasks, err := s.taskRepo.ReclaimStaleTasks(s.ctx, s.environment.WorkerConfiguration.MaxRetries)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to reclaim stale tasks: %v", err))
+	}
+
+	if len(tasks) > 0 {
+		s.notifier.Notify()
+		s.queueChanged.Notify()
+	}
+
+	for historyID, task := range failedTasks {
+		s.logger.Warn(fmt.Sprintf("Stale task %d: %s failed after %d attempts", task.ID, task.Link, task.Attempts))
 
-		taskCount++
-		s.logger.Debug(fmt.Sprintf("Found task %d: %s for groups %v", task.ID, task.Link, task.GroupIDs))
+		for _, groupID := range task.GroupIDs {
+			messageID := task.StatusMessageIDs[groupID]
+			if messageID == 0 {
+				continue
+			}
+			s.emit(entity.VideoProcessFailure{GroupID: groupID, MessageID: messageID, ErrorMessage: task.LastError, HistoryID: historyID})
+		}
+	}
+
+	for _, task := range tasks {
+		s.logger.Info(fmt.Sprintf("Reclaimed stale task %d: %s for groups %v", task.ID, task.Link, task.GroupIDs))
+
+		// Let the waiting groups know their request was not lost
+		for _, groupID := range task.GroupIDs {
+			messageID := task.StatusMessageIDs[groupID]
+			if messageID == 0 {
+				continue
+			}
+			select {
+			case s.eventChannel <- entity.VideoProcessResumed{GroupID: groupID, MessageID: messageID}:
+				s.logger.Debug(fmt.Sprintf("Successfully emitted process resumed event for group %d", groupID))
+			default:
+				s.logger.Warn(fmt.Sprintf("Event channel is full, dropping process resumed event for group %d", groupID))
+			}
+		}
+	}
+}
+
+// queueReporter keeps the status messages of queued tasks up to date with their queue position.
+// Changes of the queue are coalesced, so a burst of new tasks results in a single refresh.
+func (s *VideoService) queueReporter() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.queueChanged.Signals():
+			s.reportQueuePositions()
+		}
+	}
+}
+
+// reportQueuePositions shows every queued task its position in the order the workers take the tasks
+func (s *VideoService) reportQueuePositions() {
+	tasks, err := s.taskRepo.ListPendingTasks(s.ctx, s.environment.WorkerConfiguration.MaxConcurrentTasksPerGroup)
+	if err != nil {
+		s.logger.Warn(fmt.Sprintf("Failed to list pending tasks: %v", err))
+		return
+	}
+
+	averageTime, err := s.taskRepo.AverageProcessingTime(s.ctx, core.QueueETASampleSize)
+	if err != nil {
+		s.logger.Warn(fmt.Sprintf("Failed to estimate processing time: %v", err))
+	}
 
-		// Mark task as in progress immediately to prevent duplicate processing
-		s.logger.Debug(fmt.Sprintf("Marking task %d as in progress", task.ID))
-		if err := s.taskRepo.MarkTaskInProgress(task.ID); err != nil {
-			s.logger.Debug(fmt.Sprintf("Failed to mark task %d as in progress: %v", task.ID, err))
+	s.queueMutex.Lock()
+	defer s.queueMutex.Unlock()
+
+	queued := make(map[queueEntry]bool)
+	for i, task := range tasks {
+		position := i + 1
+		eta := s.estimateWait(position, averageTime)
+		// A task waiting to be retried is not started before it is due
+		if task.NextAttemptAt != nil {
+			eta = max(eta, time.Until(*task.NextAttemptAt)+averageTime)
+		}
+
+		for _, groupID := range task.GroupIDs {
+			entry := queueEntry{taskID: task.ID, groupID: groupID}
+			queued[entry] = true
+
+			messageID := task.StatusMessageIDs[groupID]
+			if messageID == 0 || s.queueShown[entry] == position {
+				continue
+			}
+			s.queueShown[entry] = position
+
+			select {
+			case s.eventChannel <- entity.VideoQueuePositionChanged{GroupID: groupID, MessageID: messageID, Position: position, ETA: eta}:
+				s.logger.Debug(fmt.Sprintf("Emitted queue position %d of task %d for group %d", position, task.ID, groupID))
+			default:
+				s.logger.Warn(fmt.Sprintf("Event channel is full, dropping queue position event for group %d", groupID))
+			}
+		}
+	}
+
+	// Forget tasks which left the queue without being started here, e.g. cancelled or taken by another instance
+	for entry := range s.queueShown {
+		if !queued[entry] {
+			delete(s.queueShown, entry)
+		}
+	}
+}
+
+// estimateWait estimates how long a task at the given queue position waits until its video is ready
+func (s *VideoService) estimateWait(position int, averageTime time.Duration) time.Duration {
+	if averageTime <= 0 {
+		return 0
+	}
+
+	// Tasks ahead are processed in parallel rounds, the task itself takes one more round
+	workerCount := s.environment.WorkerConfiguration.WorkerCount
+	rounds := (position-1)/workerCount + 1
+	return time.Duration(rounds) * averageTime
+}
+
+// reportDownloadStarted replaces the queue position shown for a task that was just claimed
+func (s *VideoService) reportDownloadStarted(task *VideoTask) {
+	s.queueMutex.Lock()
+	defer s.queueMutex.Unlock()
+
+	for _, groupID := range task.GroupIDs {
+		entry := queueEntry{taskID: task.ID, groupID: groupID}
+		if _, shown := s.queueShown[entry]; !shown {
 			continue
 		}
-		s.logger.Debug(fmt.Sprintf("Successfully marked task %d as in progress", task.ID))
+		delete(s.queueShown, entry)
 
-		// Try to queue the task (non-blocking)
-		s.logger.Debug(fmt.Sprintf("Attempting to queue task %d", task.ID))
+		messageID := task.StatusMessageIDs[groupID]
 		select {
-		case s.taskQueue <- VideoTask{ID: task.ID, Link: task.Link, GroupIDs: task.GroupIDs, StatusMessageIDs: task.StatusMessageIDs}:
-			// Task queued successfully
-			s.logger.Debug(fmt.Sprintf("Queued task %d for processing in %d groups", task.ID, len(task.GroupIDs)))
+		case s.eventChannel <- entity.VideoDownloadStarted{GroupID: groupID, MessageID: messageID}:
+			s.logger.Debug(fmt.Sprintf("Successfully emitted download started event for group %d", groupID))
 		default:
-			// Queue is full, task will be picked up in next cycle
-			s.logger.Debug(fmt.Sprintf("Task queue is full, task %d will be processed in next cycle", task.ID))
-			break
+			s.logger.Warn(fmt.Sprintf("Event channel is full, dropping download started event for group %d", groupID))
 		}
 	}
+}
 
-	if taskCount == 0 {
-		s.logger.Debug("scheduleAvailableTasks completed - no tasks found")
-	} else {
-		s.logger.Debug(fmt.Sprintf("scheduleAvailableTasks completed - processed %d tasks", taskCount))
+func (s *VideoService) historyPruner() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(core.TaskHistoryPruneInterval)
+	defer ticker.Stop()
+
+	s.pruneHistory()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.pruneHistory()
+		}
+	}
+}
+
+func (s *VideoService) pruneHistory() {
+	retention := time.Duration(s.environment.WorkerConfiguration.HistoryRetentionDays) * 24 * time.Hour
+
+	count, err := s.taskRepo.PruneHistory(s.ctx, time.Now().Add(-retention))
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to prune task history: %v", err))
+		return
+	}
+
+	if count > 0 {
+		s.logger.Debug(fmt.Sprintf("Pruned %d task history entries", count))
 	}
 }
 
-func (s *VideoService) worker() {
+// startLeaseRenewal keeps renewing the lease of a task until the returned function is called.
+// Processing is cancelled when the lease is lost, e.g. when the task was cancelled.
+func (s *VideoService) startLeaseRenewal(taskID int, workerID string, cancelTask context.CancelFunc) func() {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(s.environment.WorkerConfiguration.HeartbeatIntervalSeconds) * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				err := s.taskRepo.RenewLease(s.ctx, taskID, workerID, s.leaseDuration())
+				if errors.Is(err, botEntity.ErrTaskLeaseLost) {
+					s.logger.Info(fmt.Sprintf("Lost lease of task %d, aborting processing", taskID))
+					cancelTask()
+					return
+				}
+				if err != nil {
+					s.logger.Warn(fmt.Sprintf("Failed to renew lease of task %d: %v", taskID, err))
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// claimTask atomically claims the next due task for the worker, keeping the queue fair across groups.
+// The worker that claims a task is the one that processes it, so a task
+// is never marked in progress without a worker.
+func (s *VideoService) claimTask(workerID string) *VideoTask {
+	maxTasksPerGroup := s.environment.WorkerConfiguration.MaxConcurrentTasksPerGroup
+	task, err := s.taskRepo.ClaimNextTask(s.ctx, workerID, s.leaseDuration(), maxTasksPerGroup)
+	if err != nil {
+		// No tasks available
+		s.logger.Debug(fmt.Sprintf("No tasks available for worker %s: %v", workerID, err))
+		return nil
+	}
+
+	s.logger.Debug(fmt.Sprintf("Worker %s claimed task %d: %s for groups %v", workerID, task.ID, task.Link, task.GroupIDs))
+
+	return &VideoTask{
+		ID:               task.ID,
+		WorkerID:         workerID,
+		Link:             task.Link,
+		Mode:             task.Mode,
+		GroupIDs:         task.GroupIDs,
+		StatusMessageIDs: task.StatusMessageIDs,
+		Requesters:       task.Requesters,
+		Attempts:         task.Attempts,
+	}
+}
+
+func (s *VideoService) worker(workerID string) {
 	defer s.wg.Done()
 
 	for {
 		select {
-		case <-s.stopChannel:
+		case <-s.ctx.Done():
 			return
-		case task := <-s.taskQueue:
-			// Process the task
+		default:
+		}
+
+		if task := s.claimTask(workerID); task != nil {
+			// There may be more tasks waiting, let another idle worker check
+			s.notifier.Notify()
+
+			// The queue moved, let the waiting groups know
+			s.reportDownloadStarted(task)
+			s.queueChanged.Notify()
+
 			s.logger.Debug(fmt.Sprintf("Worker processing task %d for groups %v", task.ID, task.GroupIDs))
-			s.processTask(task.ID, task.Link, task.GroupIDs, task.StatusMessageIDs)
+			s.processTask(*task)
+			continue
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.notifier.Signals():
 		}
 	}
 }
 
-func (s *VideoService) processTask(taskID int, link string, groupIDs []int64, statusMessageIDs map[int64]int) {
+func (s *VideoService) processTask(task VideoTask) {
+	taskID, link, groupIDs, statusMessageIDs := task.ID, task.Link, task.GroupIDs, task.StatusMessageIDs
+
 	s.logger.Debug(fmt.Sprintf("Starting to process task %d with link: %s for groups: %v", taskID, link, groupIDs))
 
-	_, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	// The task context is cancelled by CancelVideo or when the lease is lost
+	taskCtx, cancelTask := context.WithCancel(s.ctx)
+	defer cancelTask()
+	s.trackRunningTask(taskID, cancelTask)
+	defer s.untrackRunningTask(taskID)
+
+	stopLeaseRenewal := s.startLeaseRenewal(taskID, task.WorkerID, cancelTask)
+	defer stopLeaseRenewal()
 
 	// Validate URL first
 	isValid, platformName, err := s.downloadRepo.ValidateURL(link)
 	if err != nil || !isValid {
 		s.logger.Debug(fmt.Sprintf("URL validation failed for task %d: %v", taskID, err))
-		s.handleTaskFailure(taskID, groupIDs, statusMessageIDs, fmt.Sprintf("Invalid URL: %v", err))
+		s.handleTaskFailure(task, fmt.Sprintf("Invalid URL: %v", err), entity.FailureKindPermanent)
 		return
 	}
 
 	s.logger.Debug(fmt.Sprintf("Processing %s video: %s", platformName, link))
+	task.Platform = platformName
+
+	// Read the metadata first, so media over the limits is rejected without downloading it
+	probeCtx, cancelProbe := context.WithTimeout(taskCtx, core.MetadataProbeTimeout)
+	metadata, err := s.downloadRepo.ProbeVideo(probeCtx, link)
+	cancelProbe()
+
+	if s.interrupted(task, taskCtx) {
+		return
+	}
+
+	format := ""
+	if err != nil {
+		// The download reports the same problem with a proper failure kind, so it is attempted anyway
+		s.logger.Warn(fmt.Sprintf("Failed to probe metadata of task %d, downloading with the configured quality: %v", taskID, err))
+	} else {
+		format, err = s.planDownload(metadata, task.Mode)
+		if err != nil {
+			s.logger.Debug(fmt.Sprintf("Task %d rejected by the metadata probe: %v", taskID, err))
+			s.handleTaskFailure(task, err.Error(), entity.FailureKindPermanent)
+			return
+		}
+	}
+
+	// Download video to a directory of its own, so concurrent tasks never see each other's files.
+	// Leftovers of a previous attempt are removed first, the directory is removed when the task is done.
+	outputDir := filepath.Join(core.VideoOutputDirectory, fmt.Sprintf("task-%d", taskID))
+	if err := os.RemoveAll(outputDir); err != nil {
+		s.logger.Warn(fmt.Sprintf("Failed to clean up directory %s: %v", outputDir, err))
+	}
+	defer s.removeTaskDirectory(outputDir)
 
-	// Download video to a shared directory (use first group ID for directory)
-	outputDir := fmt.Sprintf("%s/shared", core.VideoOutputDirectory)
 	s.logger.Debug(fmt.Sprintf("Starting download for task %d to directory: %s", taskID, outputDir))
 
-	result, err := s.downloadRepo.DownloadVideo(link, outputDir)
+	downloadTimeout := time.Duration(s.environment.WorkerConfiguration.DownloadTimeoutSeconds) * time.Second
+	downloadCtx, cancelDownload := context.WithTimeout(taskCtx, downloadTimeout)
+	var result *entity.VideoProcessResult
+	if task.Mode == botEntity.TaskModeAudio {
+		result, err = s.downloadRepo.DownloadAudio(downloadCtx, link, outputDir, s.progressReporter(task))
+	} else {
+		result, err = s.downloadRepo.DownloadVideo(downloadCtx, link, outputDir, format, s.progressReporter(task))
+	}
+	cancelDownload()
+
+	if s.interrupted(task, taskCtx) {
+		return
+	}
+
 	if err != nil || !result.Success {
 		s.logger.Debug(fmt.Sprintf("Download failed for task %d: %v", taskID, err))
+		downloadErr, failureKind := err, entity.FailureKindTransient
 		if result != nil {
 			s.logger.Debug(fmt.Sprintf("Download result error: %v", result.Error))
+			downloadErr, failureKind = result.Error, result.FailureKind
 		}
-		s.handleTaskFailure(taskID, groupIDs, statusMessageIDs, fmt.Sprintf("Download failed: %v", result.Error))
+		s.handleTaskFailure(task, fmt.Sprintf("Download failed: %v", downloadErr), failureKind)
 		return
 	}
 
 	s.logger.Debug(fmt.Sprintf("Download successful for task %d, file: %s", taskID, result.FilePath))
 
+	if err := s.fitUploadLimit(taskCtx, task, result); err != nil {
+		if s.interrupted(task, taskCtx) {
+			return
+		}
+		s.logger.Debug(fmt.Sprintf("Task %d does not fit the upload limit: %v", taskID, err))
+		s.handleTaskFailure(task, err.Error(), entity.FailureKindPermanent)
+		return
+	}
+
+	s.inspectVideos(taskCtx, task, result)
+
+	// Groups may have cancelled or joined the task during the download
+	currentTask, err := s.taskRepo.GetTask(taskCtx, taskID)
+	if err != nil || currentTask.Status != botEntity.TaskStatusInProgress || currentTask.WorkerID != task.WorkerID {
+		s.abandonTask(task)
+		return
+	}
+	task.GroupIDs, task.StatusMessageIDs = currentTask.GroupIDs, currentTask.StatusMessageIDs
+	task.Requesters = currentTask.Requesters
+	groupIDs, statusMessageIDs = task.GroupIDs, task.StatusMessageIDs
+
 	// Emit upload started events for all groups
 	for _, groupID := range groupIDs {
 		messageID := statusMessageIDs[groupID]
 		if messageID > 0 {
 			s.logger.Debug(fmt.Sprintf("Emitting upload started event for group %d", groupID))
-			select {
-			case s.eventChannel <- entity.VideoUploadStarted{GroupID: groupID, MessageID: messageID}:
-				s.logger.Debug(fmt.Sprintf("Successfully emitted upload started event for group %d", groupID))
-			default:
-				s.logger.Warn(fmt.Sprintf("Event channel is full, dropping upload started event for group %d", groupID))
-			}
+			s.emit(entity.VideoUploadStarted{GroupID: groupID, MessageID: messageID})
 		}
 	}
 
-	// Upload to all groups
-	uploadCount := 0
+	// Upload to all groups. Uploads are not interrupted by shutdown, so groups don't receive
+	// the same video twice when the task is processed again, they are bound by a timeout instead.
+	uploadTimeout := time.Duration(s.environment.WorkerConfiguration.UploadTimeoutSeconds) * time.Second
+	failedUploads := make(map[int64]error)
 	for _, groupID := range groupIDs {
 		s.logger.Debug(fmt.Sprintf("Uploading to group %d", groupID))
-		err = s.uploadRepo.UploadVideo(result.FilePath, groupID)
+		uploadCtx, cancelUpload := context.WithTimeout(context.WithoutCancel(s.ctx), uploadTimeout)
+		err = s.uploadResult(uploadCtx, result, s.captionValues(task, result, groupID), groupID)
+		cancelUpload()
 		if err != nil {
-			s.logger.Debug(fmt.Sprintf("Failed to upload to group %d: %v", groupID, err))
+			s.logger.Warn(fmt.Sprintf("Failed to upload task %d to group %d: %v", taskID, groupID, err))
+			failedUploads[groupID] = err
 			// Continue uploading to other groups
 		} else {
-			uploadCount++
 			s.logger.Debug(fmt.Sprintf("Successfully uploaded to group %d", groupID))
 		}
 	}
 
-	// Success - clean up and notify all groups
-	s.logger.Debug(fmt.Sprintf("Cleaning up file: %s", result.FilePath))
-	os.Remove(result.FilePath)
+	// Nobody received the media, so the task is retried unless no group can receive it at all
+	if len(failedUploads) == len(groupIDs) {
+		failureKind := entity.FailureKindPermanent
+		var uploadErr error
+		for _, err := range failedUploads {
+			uploadErr = err
+			if !errors.Is(err, entity.ErrChatUnavailable) {
+				failureKind = entity.FailureKindTransient
+				break
+			}
+		}
+		s.handleTaskFailure(task, fmt.Sprintf("Upload failed: %v", uploadErr), failureKind)
+		return
+	}
 
-	s.logger.Debug(fmt.Sprintf("Calling success handler for task %d with %d successful uploads", taskID, uploadCount))
-	s.handleTaskSuccess(taskID, groupIDs, statusMessageIDs)
+	// The task directory is removed on return
+	s.logger.Debug(fmt.Sprintf("Calling success handler for task %d with %d failed uploads", taskID, len(failedUploads)))
+	s.handleTaskSuccess(task, result, failedUploads)
 }
 
-func (s *VideoService) handleTaskSuccess(taskID int, groupIDs []int64, statusMessageIDs map[int64]int) {
+// handleTaskSuccess archives the task uploaded to at least one of its groups. The groups whose upload
+// failed receive a failure event instead of the success one.
+func (s *VideoService) handleTaskSuccess(task VideoTask, result *entity.VideoProcessResult, failedUploads map[int64]error) {
+	taskID, groupIDs, statusMessageIDs := task.ID, task.GroupIDs, task.StatusMessageIDs
+
 	s.logger.Debug(fmt.Sprintf("handleTaskSuccess called for task %d, groups %v", taskID, groupIDs))
 
-	// Delete completed task
-	if err := s.taskRepo.DeleteTask(taskID); err != nil {
-		s.logger.Debug(fmt.Sprintf("Failed to delete completed task %d: %v", taskID, err))
+	// Move completed task to the history
+	outcome := botEntity.TaskOutcome{
+		Status:   botEntity.TaskStatusCompleted,
+		Platform: task.Platform,
+		FileSize: result.FileSize,
+		Duration: result.Duration,
+	}
+	if len(failedUploads) > 0 {
+		outcome.Error = fmt.Sprintf("upload failed for %d of %d groups", len(failedUploads), len(groupIDs))
+	}
+	historyID, err := s.taskRepo.ArchiveTask(context.WithoutCancel(s.ctx), taskID, task.WorkerID, outcome)
+	if err != nil {
+		// The media was delivered anyway, so the groups are told
+		s.logger.Warn(fmt.Sprintf("Failed to archive completed task %d: %v", taskID, err))
 	} else {
-		s.logger.Debug(fmt.Sprintf("Successfully deleted completed task %d", taskID))
+		s.logger.Debug(fmt.Sprintf("Successfully archived completed task %d", taskID))
 	}
 
-	// Emit success events for all groups
+	s.cacheUploadedMedia(task, result)
+
+	// Emit success events for the groups that received the media
 	for _, groupID := range groupIDs {
 		messageID := statusMessageIDs[groupID]
-		s.logger.Debug(fmt.Sprintf("Emitting success event for group %d with messageID=%d", groupID, messageID))
-		select {
-		case s.eventChannel <- entity.VideoProcessSuccess{GroupID: groupID, MessageID: messageID}:
-			s.logger.Debug(fmt.Sprintf("Successfully emitted success event for group %d", groupID))
-		default:
-			s.logger.Warn(fmt.Sprintf("Event channel is full, dropping success event for group %d", groupID))
+		if uploadErr, failed := failedUploads[groupID]; failed {
+			s.emitUploadFailure(groupID, messageID, historyID, uploadErr)
+			continue
 		}
+		s.logger.Debug(fmt.Sprintf("Emitting success event for group %d with messageID=%d", groupID, messageID))
+		s.emit(entity.VideoProcessSuccess{GroupID: groupID, MessageID: messageID})
 	}
 
 	s.logger.Debug(fmt.Sprintf("Successfully processed video for groups %v", groupIDs))
 }
 
-func (s *VideoService) handleTaskFailure(taskID int, groupIDs []int64, statusMessageIDs map[int64]int, errorMessage string) {
+// emitUploadFailure tells the group its upload failed. A group the bot can't post to is not told,
+// the message could not be delivered anyway.
+func (s *VideoService) emitUploadFailure(groupID int64, messageID int, historyID int, uploadErr error) {
+	if errors.Is(uploadErr, entity.ErrChatUnavailable) {
+		s.logger.Warn(fmt.Sprintf("Group %d is unavailable to the bot, not reporting the failed upload: %v", groupID, uploadErr))
+		return
+	}
+
+	s.logger.Debug(fmt.Sprintf("Emitting upload failure event for group %d with messageID=%d", groupID, messageID))
+	s.emit(entity.VideoProcessFailure{GroupID: groupID, MessageID: messageID, ErrorMessage: fmt.Sprintf("Upload failed: %v", uploadErr), HistoryID: historyID})
+}
+
+func (s *VideoService) handleTaskFailure(task VideoTask, errorMessage string, failureKind entity.FailureKind) {
+	taskID, groupIDs, statusMessageIDs := task.ID, task.GroupIDs, task.StatusMessageIDs
+
 	s.logger.Debug(fmt.Sprintf("handleTaskFailure called for task %d, groups %v, error: %s", taskID, groupIDs, errorMessage))
 
-	// Delete failed task
-	if err := s.taskRepo.DeleteTask(taskID); err != nil {
-		s.logger.Debug(fmt.Sprintf("Failed to delete failed task %d: %v", taskID, err))
+	// Transient failures go back to the queue until the retry limit is reached
+	if failureKind != entity.FailureKindPermanent && task.Attempts < s.environment.WorkerConfiguration.MaxRetries {
+		delay := s.retryDelay(task.Attempts)
+		err := s.taskRepo.ScheduleRetry(context.WithoutCancel(s.ctx), taskID, task.WorkerID, errorMessage, time.Now().Add(delay))
+		if errors.Is(err, botEntity.ErrTaskLeaseLost) {
+			s.abandonTask(task)
+			return
+		}
+		if err != nil {
+			s.logger.Debug(fmt.Sprintf("Failed to schedule retry for task %d: %v", taskID, err))
+		} else {
+			s.logger.Debug(fmt.Sprintf("Scheduled retry %d/%d for task %d in %s", task.Attempts+1, s.environment.WorkerConfiguration.MaxRetries, taskID, delay))
+			// The task moves up in the queue once it is due
+			time.AfterFunc(delay, func() {
+				s.notifier.Notify()
+				s.queueChanged.Notify()
+			})
+			s.queueChanged.Notify()
+			return
+		}
+	}
+
+	// Move failed task to the history
+	outcome := botEntity.TaskOutcome{
+		Status:   botEntity.TaskStatusFailed,
+		Platform: task.Platform,
+		Error:    errorMessage,
+	}
+	historyID, err := s.taskRepo.ArchiveTask(context.WithoutCancel(s.ctx), taskID, task.WorkerID, outcome)
+	if errors.Is(err, botEntity.ErrTaskLeaseLost) {
+		// The worker which took the task over reports its outcome
+		s.abandonTask(task)
+		return
+	}
+	if err != nil {
+		s.logger.Debug(fmt.Sprintf("Failed to archive failed task %d: %v", taskID, err))
 	} else {
-		s.logger.Debug(fmt.Sprintf("Successfully deleted failed task %d", taskID))
+		s.logger.Debug(fmt.Sprintf("Successfully archived failed task %d", taskID))
 	}
 
 	// Emit failure events for all groups
 	for _, groupID := range groupIDs {
 		messageID := statusMessageIDs[groupID]
 		s.logger.Debug(fmt.Sprintf("Emitting failure event for group %d with messageID=%d, error=%s", groupID, messageID, errorMessage))
-		select {
-		case s.eventChannel <- entity.VideoProcessFailure{GroupID: groupID, MessageID: messageID, ErrorMessage: errorMessage}:
-			s.logger.Debug(fmt.Sprintf("Successfully emitted failure event for group %d", groupID))
-		default:
-			s.logger.Warn(fmt.Sprintf("Event channel is full, dropping failure event for group %d", groupID))
-		}
+		s.emit(entity.VideoProcessFailure{GroupID: groupID, MessageID: messageID, ErrorMessage: errorMessage, HistoryID: historyID})
 	}
 
 	s.logger.Debug(fmt.Sprintf("Failed to process video for groups %v: %s", groupIDs, errorMessage))
 }
+
+// uploadResult sends the processed media to the group. Files are uploaded to the first group only,
+// the others receive them by the file_id Telegram assigned to them. The caption is put on the first item,
+// which Telegram shows as the caption of the whole media group.
+func (s *VideoService) uploadResult(ctx context.Context, result *entity.VideoProcessResult, captionValues entity.CaptionValues, groupID int64) error {
+	if !result.IsSingleVideo() {
+		// The captions differ between groups, the items of the result keep only the file_ids
+		items := slices.Clone(result.Items)
+		for i := range items {
+			if i == 0 {
+				items[i].Caption = s.captions.Build(captionValues, items[i].Caption)
+			} else {
+				items[i].Caption = s.captions.Escape(items[i].Caption)
+			}
+		}
+
+		uploaded, err := s.uploadRepo.UploadMedia(ctx, items, groupID)
+		if err != nil {
+			return err
+		}
+		if len(result.Items) == 1 && len(uploaded) == 1 && result.Uploaded == nil {
+			result.Uploaded = &uploaded[0]
+		}
+		for i := range result.Items {
+			if i < len(uploaded) && result.Items[i].FileID == "" {
+				result.Items[i].FileID = uploaded[i].FileID
+			}
+		}
+		return nil
+	}
+
+	caption := s.captions.Build(captionValues, "")
+	if result.Uploaded != nil && result.Uploaded.FileID != "" {
+		return s.uploadRepo.SendVideo(ctx, result.Uploaded.FileID, caption, groupID)
+	}
+
+	uploaded, err := s.uploadRepo.UploadVideo(ctx, result, caption, groupID)
+	if err != nil {
+		return err
+	}
+	result.Uploaded = uploaded
+	return nil
+}
+
+// captionValues collects the values of the caption the group receives the result of the task with
+func (s *VideoService) captionValues(task VideoTask, result *entity.VideoProcessResult, groupID int64) entity.CaptionValues {
+	return entity.CaptionValues{
+		Title:     result.Title,
+		Uploader:  result.Uploader,
+		Platform:  task.Platform,
+		Link:      task.Link,
+		Duration:  result.Duration,
+		Requester: task.Requesters[groupID],
+	}
+}
+
+// cacheUploadedMedia remembers the uploaded file for the link of the task, so the next request
+// of the link in the same mode is answered without downloading it. Split videos and multi-item
+// posts are not cached.
+func (s *VideoService) cacheUploadedMedia(task VideoTask, result *entity.VideoProcessResult) {
+	if !result.IsSingleVideo() && !result.IsSingleAudio() {
+		return
+	}
+	if result.Uploaded == nil || result.Uploaded.FileID == "" {
+		return
+	}
+
+	media := entity.CachedMedia{
+		Mode:         task.Mode,
+		FileID:       result.Uploaded.FileID,
+		FileUniqueID: result.Uploaded.FileUniqueID,
+		FileSize:     result.FileSize,
+		Duration:     result.Duration,
+		Title:        result.Title,
+		Uploader:     result.Uploader,
+	}
+	if err := s.mediaCache.SaveMedia(context.WithoutCancel(s.ctx), task.Link, media); err != nil {
+		s.logger.Warn(fmt.Sprintf("Failed to cache uploaded media of task %d: %v", task.ID, err))
+	}
+}
+
+// releaseTask puts a task interrupted by shutdown back to the queue without counting an attempt
+func (s *VideoService) releaseTask(task VideoTask) {
+	if err := s.taskRepo.ReleaseTask(context.WithoutCancel(s.ctx), task.ID, task.WorkerID); err != nil {
+		s.logger.Warn(fmt.Sprintf("Failed to release interrupted task %d: %v", task.ID, err))
+		return
+	}
+
+	s.logger.Info(fmt.Sprintf("Released interrupted task %d back to the queue", task.ID))
+}
+
+// fitUploadLimit makes sure the downloaded video fits the upload limit. A video that doesn't is
+// re-encoded, and when that is not enough, cut into parts. The result is updated to point to the
+// re-encoded file or to the parts.
+func (s *VideoService) fitUploadLimit(ctx context.Context, task VideoTask, result *entity.VideoProcessResult) error {
+	// Audio is not re-encoded, the configured quality is expected to fit
+	if task.Mode == botEntity.TaskModeAudio {
+		maxSizeMB := int64(s.environment.AudioDownloaderConfiguration.MaxFileSizeMB)
+		if result.FileSize > maxSizeMB*1024*1024 {
+			return fmt.Errorf("audio size %d MB exceeds limit of %d MB", result.FileSize/(1024*1024), maxSizeMB)
+		}
+		return nil
+	}
+
+	if !result.IsSingleVideo() {
+		return s.fitItemsUploadLimit(ctx, task, result)
+	}
+
+	config := s.environment.CompressionConfiguration
+	maxSizeMB := int64(s.environment.VideoDownloaderConfiguration.MaxFileSizeMB)
+	maxSize := maxSizeMB * 1024 * 1024
+	if result.FileSize <= maxSize {
+		return nil
+	}
+
+	if !config.Enabled && !config.SplitEnabled {
+		return fmt.Errorf("file size %d MB exceeds limit of %d MB", result.FileSize/(1024*1024), maxSizeMB)
+	}
+
+	s.logger.Debug(fmt.Sprintf("File of task %d is %d MB, shrinking to fit %d MB", task.ID, result.FileSize/(1024*1024), maxSizeMB))
+	s.emitToGroups(task, func(groupID int64, messageID int) entity.VideoEvent {
+		return entity.VideoCompressionStarted{GroupID: groupID, MessageID: messageID}
+	})
+
+	originalSizeMB := result.FileSize / (1024 * 1024)
+
+	if config.Enabled {
+		err := s.compressVideo(ctx, task, result, maxSize)
+		if err == nil {
+			return nil
+		}
+		if !config.SplitEnabled || !errors.Is(err, entity.ErrCompressionInsufficient) {
+			return fmt.Errorf("file size %d MB exceeds limit of %d MB: %w", originalSizeMB, maxSizeMB, err)
+		}
+	}
+
+	// Too large even for the maximum number of parts, so it is re-encoded to fit all of them together first
+	if config.Enabled && result.FileSize > int64(config.MaxParts)*maxSize*core.CompressionTargetPercent/100 {
+		if err := s.compressVideo(ctx, task, result, int64(config.MaxParts)*maxSize); err != nil {
+			return fmt.Errorf("file size %d MB exceeds limit of %d MB: %w", originalSizeMB, maxSizeMB, err)
+		}
+	}
+
+	parts, err := s.compressRepo.SplitVideo(ctx, result.FilePath, result.Duration, maxSize, config.MaxParts)
+	if err != nil {
+		return fmt.Errorf("file size %d MB exceeds limit of %d MB: %w", originalSizeMB, maxSizeMB, err)
+	}
+
+	s.logger.Debug(fmt.Sprintf("Split task %d into %d parts", task.ID, len(parts)))
+	// The dimensions, durations and thumbnails of the parts are read by inspectVideos like for any video
+	result.Items = make([]entity.MediaItem, 0, len(parts))
+	for _, part := range parts {
+		result.Items = append(result.Items, entity.MediaItem{
+			Type:     entity.MediaTypeVideo,
+			FilePath: part.FilePath,
+			FileSize: part.FileSize,
+			Caption:  fmt.Sprintf("Part %d/%d", part.Number, part.Total),
+		})
+	}
+	return nil
+}
+
+// fitItemsUploadLimit makes sure every item of a multi-item post fits the upload limit.
+// Videos that don't are re-encoded, they are not split, so the post keeps its items.
+func (s *VideoService) fitItemsUploadLimit(ctx context.Context, task VideoTask, result *entity.VideoProcessResult) error {
+	maxSizeMB := int64(s.environment.VideoDownloaderConfiguration.MaxFileSizeMB)
+	maxSize := maxSizeMB * 1024 * 1024
+
+	for i := range result.Items {
+		item := &result.Items[i]
+		if item.FileSize <= maxSize {
+			continue
+		}
+
+		if item.Type != entity.MediaTypeVideo || !s.environment.CompressionConfiguration.Enabled {
+			return fmt.Errorf("item %d of %d is %d MB and exceeds limit of %d MB",
+				i+1, len(result.Items), item.FileSize/(1024*1024), maxSizeMB)
+		}
+
+		s.logger.Debug(fmt.Sprintf("Item %d of task %d is %d MB, shrinking to fit %d MB", i+1, task.ID, item.FileSize/(1024*1024), maxSizeMB))
+		s.emitToGroups(task, func(groupID int64, messageID int) entity.VideoEvent {
+			return entity.VideoCompressionStarted{GroupID: groupID, MessageID: messageID}
+		})
+
+		compression, err := s.compressRepo.CompressVideo(ctx, item.FilePath, item.Duration, maxSize)
+		if err != nil {
+			return fmt.Errorf("item %d of %d is %d MB and exceeds limit of %d MB: %w",
+				i+1, len(result.Items), item.FileSize/(1024*1024), maxSizeMB, err)
+		}
+
+		result.FileSize += compression.FileSize - item.FileSize
+		item.FilePath = compression.FilePath
+		item.FileSize = compression.FileSize
+	}
+
+	return nil
+}
+
+// compressVideo re-encodes the downloaded video to fit into maxSize and points the result to the new file
+func (s *VideoService) compressVideo(ctx context.Context, task VideoTask, result *entity.VideoProcessResult, maxSize int64) error {
+	compression, err := s.compressRepo.CompressVideo(ctx, result.FilePath, result.Duration, maxSize)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Debug(fmt.Sprintf("Re-encoded task %d from %d MB to %d MB at %d kbit/s, %dp, in %d attempts",
+		task.ID, compression.OriginalSize/(1024*1024), compression.FileSize/(1024*1024),
+		compression.VideoBitrateKbps, compression.Height, compression.Attempts))
+
+	// The original is removed together with the task directory
+	result.FilePath = compression.FilePath
+	result.FileName = filepath.Base(compression.FilePath)
+	result.FileSize = compression.FileSize
+	result.Compression = compression
+	result.Items[0].FilePath = compression.FilePath
+	result.Items[0].FileSize = compression.FileSize
+	return nil
+}
+
+// inspectVideos reads the dimensions and the duration of the videos to upload and extracts their thumbnails,
+// so Telegram shows them with the right aspect ratio, length and preview. The files are final at this point,
+// re-encoded or cut if needed. A video that can't be inspected is uploaded without its attributes.
+func (s *VideoService) inspectVideos(ctx context.Context, task VideoTask, result *entity.VideoProcessResult) {
+	for i := range result.Items {
+		item := &result.Items[i]
+		if item.Type != entity.MediaTypeVideo {
+			continue
+		}
+
+		inspectCtx, cancelInspect := context.WithTimeout(ctx, core.VideoInspectTimeout)
+		attributes, err := s.compressRepo.InspectVideo(inspectCtx, item.FilePath)
+		if err != nil {
+			cancelInspect()
+			s.logger.Warn(fmt.Sprintf("Failed to inspect video %s of task %d: %v", filepath.Base(item.FilePath), task.ID, err))
+			continue
+		}
+
+		item.Width, item.Height = attributes.Width, attributes.Height
+		if item.Duration <= 0 {
+			item.Duration = attributes.Duration
+		}
+
+		thumbnailPath := strings.TrimSuffix(item.FilePath, filepath.Ext(item.FilePath)) + core.VideoThumbnailSuffix
+		err = s.compressRepo.ExtractThumbnail(inspectCtx, item.FilePath, item.Duration, thumbnailPath)
+		cancelInspect()
+		if err != nil {
+			s.logger.Warn(fmt.Sprintf("Failed to extract thumbnail of %s of task %d: %v", filepath.Base(item.FilePath), task.ID, err))
+		} else {
+			item.ThumbnailPath = thumbnailPath
+		}
+	}
+
+	if result.IsSingleVideo() {
+		video := result.Items[0]
+		result.Width, result.Height, result.ThumbnailPath = video.Width, video.Height, video.ThumbnailPath
+		if result.Duration <= 0 {
+			result.Duration = video.Duration
+		}
+	}
+}
+
+// emitToGroups emits the event built for every group of the task that has a status message
+func (s *VideoService) emitToGroups(task VideoTask, newEvent func(groupID int64, messageID int) entity.VideoEvent) {
+	for _, groupID := range task.GroupIDs {
+		messageID := task.StatusMessageIDs[groupID]
+		if messageID == 0 {
+			continue
+		}
+		s.emit(newEvent(groupID, messageID))
+	}
+}
+
+// emit delivers an event changing the stage of a task, waiting while the event channel is full.
+// Only download progress and queue events, which are superseded by the next ones, are dropped right away:
+// a lost final event would leave the status message of the group stuck in a stage it has left.
+// The wait is bounded by core.EventEmitTimeout and ends on shutdown, so a stalled consumer can't hang the workers.
+func (s *VideoService) emit(event entity.VideoEvent) {
+	timer := time.NewTimer(core.EventEmitTimeout)
+	defer timer.Stop()
+
+	select {
+	case s.eventChannel <- event:
+		s.logger.Debug(fmt.Sprintf("Successfully emitted %T", event))
+	case <-s.ctx.Done():
+		s.logger.Warn(fmt.Sprintf("Shutting down, dropping %T", event))
+	case <-timer.C:
+		s.logger.Error(fmt.Sprintf("Event channel is full for %s, dropping %T", core.EventEmitTimeout, event))
+	}
+}
+
+// interrupted reports whether processing of the task has to stop because the task context is done.
+// A task interrupted by shutdown is put back to the queue, it will be picked up again after restart.
+// A task cancelled by its groups or taken over by another worker is abandoned, yt-dlp was killed
+// together with the context.
+func (s *VideoService) interrupted(task VideoTask, taskCtx context.Context) bool {
+	if s.ctx.Err() != nil {
+		s.releaseTask(task)
+		return true
+	}
+
+	if taskCtx.Err() != nil {
+		s.abandonTask(task)
+		return true
+	}
+
+	return false
+}
+
+// planDownload checks probed metadata against the configured limits and picks the format to download.
+// An empty format keeps the configured quality, a lower quality is picked when it would not fit.
+// Audio is only checked against the limits, the format is chosen by the audio configuration.
+func (s *VideoService) planDownload(metadata *entity.VideoMetadata, mode botEntity.TaskMode) (string, error) {
+	config := s.environment.VideoDownloaderConfiguration
+
+	if metadata.IsLive {
+		return "", fmt.Errorf("live streams are not supported")
+	}
+
+	if mode == botEntity.TaskModeAudio {
+		maxDuration := float64(s.environment.AudioDownloaderConfiguration.MaxDurationSeconds)
+		if metadata.Duration > maxDuration {
+			return "", fmt.Errorf("duration %s exceeds limit of %s",
+				time.Duration(metadata.Duration)*time.Second, time.Duration(maxDuration)*time.Second)
+		}
+		return "", nil
+	}
+
+	maxDuration := float64(config.MaxDurationSeconds)
+	if metadata.Duration > maxDuration {
+		return "", fmt.Errorf("duration %s exceeds limit of %s",
+			time.Duration(metadata.Duration)*time.Second, time.Duration(maxDuration)*time.Second)
+	}
+
+	// Items of a post are fitted one by one after the download
+	if metadata.ItemCount > 1 {
+		return "", nil
+	}
+
+	maxSize := int64(config.MaxFileSizeMB) * 1024 * 1024
+	if metadata.EstimatedSize <= maxSize {
+		// Fits or the size is unknown, the size is checked again after the download
+		return "", nil
+	}
+
+	format := fittingFormat(metadata.Formats, maxSize)
+	compression := s.environment.CompressionConfiguration
+	if format == "" && (compression.Enabled || compression.SplitEnabled) {
+		s.logger.Debug(fmt.Sprintf("No format fits the limit, estimated size %d MB will be shrunk after download",
+			metadata.EstimatedSize/(1024*1024)))
+		return "", nil
+	}
+	if format == "" {
+		return "", fmt.Errorf("file size %d MB exceeds limit of %d MB in any quality",
+			metadata.EstimatedSize/(1024*1024), config.MaxFileSizeMB)
+	}
+
+	s.logger.Debug(fmt.Sprintf("Estimated size %d MB exceeds limit, downloading format %s instead",
+		metadata.EstimatedSize/(1024*1024), format))
+	return format, nil
+}
+
+// fittingFormat returns the best format with a known size not exceeding maxSize, either a single
+// format with video and audio or a video-only format merged with the best fitting audio-only one.
+// Returns an empty string when nothing fits.
+func fittingFormat(formats []entity.VideoFormat, maxSize int64) string {
+	bestCombined, bestCombinedHeight := "", -1
+	var audio *entity.VideoFormat
+
+	// Formats are ordered from worst to best, so later ones win ties
+	for i := range formats {
+		format := &formats[i]
+		if format.FileSize <= 0 || format.FileSize > maxSize {
+			continue
+		}
+
+		switch {
+		case format.HasVideo && format.HasAudio:
+			if format.Height >= bestCombinedHeight {
+				bestCombined, bestCombinedHeight = format.ID, format.Height
+			}
+		case format.HasAudio:
+			audio = format
+		}
+	}
+
+	bestMerged, bestMergedHeight := "", -1
+	if audio != nil {
+		for _, format := range formats {
+			if !format.HasVideo || format.HasAudio || format.FileSize <= 0 || format.FileSize+audio.FileSize > maxSize {
+				continue
+			}
+			if format.Height >= bestMergedHeight {
+				bestMerged, bestMergedHeight = format.ID+"+"+audio.ID, format.Height
+			}
+		}
+	}
+
+	if bestMergedHeight > bestCombinedHeight {
+		return bestMerged
+	}
+	return bestCombined
+}
+
+// progressReporter returns a callback emitting download progress events for all groups of the task.
+// Events are throttled, so status messages are not edited more often than Telegram allows.
+func (s *VideoService) progressReporter(task VideoTask) entity.DownloadProgressFunc {
+	interval := s.progressInterval()
+	var lastReported time.Time
+
+	return func(progress entity.DownloadProgress) {
+		// The download is done, upload events take over the status message
+		if progress.Percent >= 100 || time.Since(lastReported) < interval {
+			return
+		}
+		lastReported = time.Now()
+
+		for _, groupID := range task.GroupIDs {
+			messageID := task.StatusMessageIDs[groupID]
+			if messageID == 0 {
+				continue
+			}
+			select {
+			case s.eventChannel <- entity.VideoDownloadProgress{GroupID: groupID, MessageID: messageID, Progress: progress}:
+				s.logger.Debug(fmt.Sprintf("Emitted download progress %.1f%% of task %d for group %d", progress.Percent, task.ID, groupID))
+			default:
+				s.logger.Warn(fmt.Sprintf("Event channel is full, dropping download progress event for group %d", groupID))
+			}
+		}
+	}
+}
+
+// progressInterval is the interval between download progress updates of a task. The configured interval is
+// raised when the tasks of a group processed at the same time would together edit their status messages
+// more often than the share of the group message limit left for progress updates.
+func (s *VideoService) progressInterval() time.Duration {
+	configured := time.Duration(s.environment.WorkerConfiguration.ProgressUpdateIntervalSeconds) * time.Second
+
+	tasksPerGroup := s.environment.WorkerConfiguration.MaxConcurrentTasksPerGroup
+	if tasksPerGroup == 0 {
+		tasksPerGroup = s.environment.WorkerConfiguration.WorkerCount
+	}
+
+	limits := s.environment.RateLimitConfiguration
+	progressEditsPerMinute := float64(limits.GroupRequestsPerMinute) *
+		float64(100-limits.UploadReservePercent) / 100 *
+		core.ProgressEditBudgetPercent / 100
+	derived := time.Duration(float64(tasksPerGroup) * float64(time.Minute) / progressEditsPerMinute)
+
+	return max(configured, derived)
+}
+
+// abandonTask stops processing a task this worker no longer owns.
+// A cancelled task is moved to the history, or back to the queue when a group requested it again meanwhile.
+// A task taken over by another worker is left alone.
+func (s *VideoService) abandonTask(task VideoTask) {
+	requeued, err := s.taskRepo.GiveUpCancelledTask(context.WithoutCancel(s.ctx), task.ID, task.WorkerID)
+	if errors.Is(err, botEntity.ErrTaskLeaseLost) {
+		s.logger.Info(fmt.Sprintf("Task %d was taken over by another worker", task.ID))
+		return
+	}
+	if err != nil {
+		s.logger.Debug(fmt.Sprintf("Failed to give up cancelled task %d: %v", task.ID, err))
+		return
+	}
+
+	if requeued {
+		s.logger.Info(fmt.Sprintf("Cancelled task %d was requested again, queued it again", task.ID))
+		s.notifier.Notify()
+		s.queueChanged.Notify()
+		return
+	}
+
+	s.logger.Debug(fmt.Sprintf("Successfully archived cancelled task %d", task.ID))
+}
+
+func (s *VideoService) trackRunningTask(taskID int, cancel context.CancelFunc) {
+	s.tasksMutex.Lock()
+	defer s.tasksMutex.Unlock()
+	s.runningTasks[taskID] = cancel
+}
+
+func (s *VideoService) untrackRunningTask(taskID int) {
+	s.tasksMutex.Lock()
+	defer s.tasksMutex.Unlock()
+	delete(s.runningTasks, taskID)
+}
+
+// cancelRunningTask aborts processing of the task if it runs on this instance
+func (s *VideoService) cancelRunningTask(taskID int) {
+	s.tasksMutex.Lock()
+	defer s.tasksMutex.Unlock()
+	if cancel, ok := s.runningTasks[taskID]; ok {
+		cancel()
+	}
+}
+
+// retryDelay returns the exponential backoff delay for a task that already failed the given number of times
+func (s *VideoService) retryDelay(attempts int) time.Duration {
+	config := s.environment.WorkerConfiguration
+	base := time.Duration(config.RetryBackoffSeconds) * time.Second
+	maxDelay := time.Duration(config.MaxRetryBackoffSeconds) * time.Second
+
+	delay := base
+	for i := 0; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, maxDelay)
+}
+
+// leaseDuration returns how long a claimed task stays with its worker without a renewal
+func (s *VideoService) leaseDuration() time.Duration {
+	return time.Duration(s.environment.WorkerConfiguration.StaleTaskTimeoutSeconds) * time.Second
+}
+
+// newInstanceID identifies this process among other bot instances sharing the database
+func newInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// removeTaskDirectory deletes the working directory of a task with everything downloaded into it
+func (s *VideoService) removeTaskDirectory(outputDir string) {
+	s.logger.Debug(fmt.Sprintf("Cleaning up directory: %s", outputDir))
+	if err := os.RemoveAll(outputDir); err != nil {
+		s.logger.Warn(fmt.Sprintf("Failed to clean up directory %s: %v", outputDir, err))
+	}
+}
\ No newline at end of file
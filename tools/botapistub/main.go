@@ -0,0 +1,206 @@
+// Command botapistub is a minimal stand-in for the Telegram Bot API server.
+// It accepts every method, logs what the bot sends and answers with plausible results,
+// so uploads can be checked without Telegram. Point telegramConfiguration.apiEndpoint
+// to "http://localhost:8081/bot%s/%s", with localBotAPI = true uploads arrive as file:// paths.
+//
+// Errors of Telegram can be injected to check how the bot handles them, e.g.
+//
+//	go run ./tools/botapistub -fail flood -retry-after 10 -fail-every 3
+//
+// answers every third upload with a flood wait of 10 seconds. The kinds of errors are
+// flood (429 with retry_after), forbidden (403, the bot was kicked) and chat-not-found (400).
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// uploadMethods are the methods failing by default, the bot keeps starting and polling
+const uploadMethods = "sendVideo,sendAudio,sendPhoto,sendAnimation,sendDocument,sendMediaGroup"
+
+// botAPIError is an error answered by the Bot API
+type botAPIError struct {
+	code        int
+	description string
+}
+
+// failureKinds are the errors that can be injected, the description of a flood wait takes its duration
+var failureKinds = map[string]botAPIError{
+	"flood":          {http.StatusTooManyRequests, "Too Many Requests: retry after %d"},
+	"forbidden":      {http.StatusForbidden, "Forbidden: bot was kicked from the supergroup chat"},
+	"chat-not-found": {http.StatusBadRequest, "Bad Request: chat not found"},
+}
+
+func main() {
+	addr := flag.String("addr", ":8081", "address to listen on")
+	kind := flag.String("fail", "", "error to answer with: flood, forbidden or chat-not-found, empty for none")
+	methods := flag.String("fail-methods", uploadMethods, "comma separated methods answered with the error")
+	every := flag.Int64("fail-every", 1, "answer every n-th request of the methods with the error")
+	retryAfter := flag.Int("retry-after", 5, "seconds to wait after a flood error")
+	flag.Parse()
+
+	failure := Failure{Every: *every, RetryAfter: *retryAfter, Methods: make(map[string]bool)}
+	if *kind != "" {
+		apiErr, ok := failureKinds[*kind]
+		if !ok {
+			log.Fatalf("Unknown error %q, expected flood, forbidden or chat-not-found", *kind)
+		}
+		if *every <= 0 {
+			log.Fatalf("-fail-every must be positive, got %d", *every)
+		}
+		failure.Error = &apiErr
+		for _, method := range strings.Split(*methods, ",") {
+			failure.Methods[strings.TrimSpace(method)] = true
+		}
+		log.Printf("Answering every %d. request of %s with %q", *every, *methods, *kind)
+	}
+
+	log.Printf("Stub Bot API listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, NewHandler(failure)))
+}
+
+// Failure makes the stub answer some requests with an error instead of a result
+type Failure struct {
+	Error      *botAPIError    // nil for no errors
+	Methods    map[string]bool // methods answered with the error
+	Every      int64           // every n-th request of the methods is answered with the error
+	RetryAfter int             // seconds of a flood wait
+}
+
+// Handler answers Bot API requests of the form /bot<token>/<method>
+type Handler struct {
+	messageID atomic.Int64
+	failure   Failure
+	requests  atomic.Int64 // requests of the failing methods so far
+}
+
+func NewHandler(failure Failure) *Handler {
+	return &Handler{
+		failure: failure,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "bot") {
+		http.NotFound(w, r)
+		return
+	}
+	method := parts[1]
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		h.reply(w, false, nil, err.Error())
+		return
+	}
+
+	h.logRequest(method, r)
+
+	if h.shouldFail(method) {
+		h.fail(w, method)
+		return
+	}
+
+	switch method {
+	case "getMe":
+		h.reply(w, true, map[string]any{"id": 1, "is_bot": true, "first_name": "Stub", "username": "stub_bot"}, "")
+	case "getUpdates":
+		// Nothing ever happens here, slow down the polling loop of the bot
+		time.Sleep(time.Second)
+		h.reply(w, true, []any{}, "")
+	case "sendMediaGroup":
+		var media []map[string]any
+		json.Unmarshal([]byte(r.FormValue("media")), &media)
+
+		messages := make([]any, 0, len(media))
+		for _, item := range media {
+			itemType, _ := item["type"].(string)
+			messages = append(messages, h.message(r, itemType))
+		}
+		h.reply(w, true, messages, "")
+	case "sendMessage", "sendVideo", "sendAnimation", "sendAudio", "sendPhoto", "sendDocument":
+		h.reply(w, true, h.message(r, strings.ToLower(strings.TrimPrefix(method, "send"))), "")
+	default:
+		h.reply(w, true, true, "")
+	}
+}
+
+// message builds the message Telegram would return for a sent message, media gets a fake file
+func (h *Handler) message(r *http.Request, mediaType string) map[string]any {
+	id := h.messageID.Add(1)
+	chatID, _ := strconv.ParseInt(r.FormValue("chat_id"), 10, 64)
+
+	message := map[string]any{
+		"message_id": id,
+		"date":       time.Now().Unix(),
+		"chat":       map[string]any{"id": chatID, "type": "supergroup"},
+	}
+
+	file := map[string]any{
+		"file_id":        fmt.Sprintf("stub-file-%d", id),
+		"file_unique_id": fmt.Sprintf("stub-unique-%d", id),
+	}
+
+	switch mediaType {
+	case "message":
+		message["text"] = r.FormValue("text")
+	case "photo":
+		message["photo"] = []any{file}
+	case "video", "animation", "audio", "document":
+		message[mediaType] = file
+	}
+
+	return message
+}
+
+// shouldFail counts the request of a failing method and tells whether it is its turn to fail
+func (h *Handler) shouldFail(method string) bool {
+	if h.failure.Error == nil || !h.failure.Methods[method] {
+		return false
+	}
+	return h.requests.Add(1)%h.failure.Every == 0
+}
+
+// fail answers with the injected error the way Telegram does, with the HTTP status of the error code
+func (h *Handler) fail(w http.ResponseWriter, method string) {
+	response := map[string]any{"ok": false, "error_code": h.failure.Error.code, "description": h.failure.Error.description}
+	if h.failure.Error.code == http.StatusTooManyRequests {
+		response["description"] = fmt.Sprintf(h.failure.Error.description, h.failure.RetryAfter)
+		response["parameters"] = map[string]any{"retry_after": h.failure.RetryAfter}
+	}
+
+	log.Printf("%s failed with %v", method, response["description"])
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(h.failure.Error.code)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *Handler) reply(w http.ResponseWriter, ok bool, result any, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"ok": ok, "result": result, "description": description})
+}
+
+// logRequest prints the parameters of a request, uploaded files are shown with their size
+func (h *Handler) logRequest(method string, r *http.Request) {
+	params := make([]string, 0, len(r.Form))
+	for key, values := range r.Form {
+		params = append(params, fmt.Sprintf("%s=%q", key, strings.Join(values, ",")))
+	}
+
+	if r.MultipartForm != nil {
+		for key, files := range r.MultipartForm.File {
+			for _, file := range files {
+				params = append(params, fmt.Sprintf("%s=<upload %s, %d bytes>", key, file.Filename, file.Size))
+			}
+		}
+	}
+
+	log.Printf("%s %s", method, strings.Join(params, " "))
+}
\ No newline at end of file